@@ -1,12 +1,15 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/j4/gosm"
 	"github.com/umahmood/haversine"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 	"log"
+	"sort"
 	"sync"
 	"time"
 	"ttnmapper-postgres-insert-gridcell/types"
@@ -15,71 +18,274 @@ import (
 // Functions specific to this aggregation type
 
 var (
-	antennaDbCache  sync.Map
-	gatewayDbCache  sync.Map
-	gridCellDbCache sync.Map
+	antennaDbCache          = antennaCache{newLruCache("antenna", 200, time.Duration(myConfiguration.AntennaCacheTtlSeconds)*time.Second)}
+	gatewayDbCache          = gatewayCache{newLruCache("gateway", 500, time.Duration(myConfiguration.GatewayCacheTtlSeconds)*time.Second)}
+	gatewayForceDbCache     = gatewayForceCache{newLruCache("gateway_force", 250, time.Duration(myConfiguration.GatewayCacheTtlSeconds)*time.Second)}
+	gatewayLocationsDbCache = gatewayLocationsCache{newLruCache("gateway_locations", 1000, time.Duration(myConfiguration.GatewayCacheTtlSeconds)*time.Second)}
+	gatewayRangeDbCache     = gatewayRangeCache{newLruCache("gateway_range", 250, time.Duration(myConfiguration.GatewayCacheTtlSeconds)*time.Second)}
+	networksRangeDbCache    = networksRangeCache{newLruCache("networks_range", 100, time.Duration(myConfiguration.GatewayCacheTtlSeconds)*time.Second)}
 )
 
-func aggregateNewData(message types.TtnMapperUplinkMessage) {
+// Grid cells are identified by these columns, which have a unique index on them
+var gridCellTable = cellTable{"grid_cells", []clause.Column{{Name: "antenna_id"}, {Name: "x"}, {Name: "y"}, {Name: "z"}, {Name: "data_rate_id"}, {Name: "frequency_band"}}}
+
+// Signal bucket and statistic columns shared by all cell tables, which are summed
+var signalBucketColumns = []string{
+	"bucket_high",
+	"bucket100",
+	"bucket105",
+	"bucket110",
+	"bucket115",
+	"bucket120",
+	"bucket125",
+	"bucket130",
+	"bucket135",
+	"bucket140",
+	"bucket145",
+	"bucket_low",
+	"bucket_no_signal",
+	"signal_count",
+	"rssi_sum",
+	"rssi_sum_squares",
+	"snr_sum",
+	"snr_sum_squares",
+}
 
-	processedLive.Inc()
+// Signal statistic columns that keep the lowest or highest value
+var (
+	signalLeastColumns    = []string{"first_seen", "rssi_min", "snr_min"}
+	signalGreatestColumns = []string{"rssi_max", "snr_max"}
+)
 
-	if message.Experiment != "" {
-		return
+// acceptNewData checks whether a live uplink can be used for coverage at all. Experiments are only used for their
+// own grid cells.
+func acceptNewData(message types.TtnMapperUplinkMessage) bool {
+	if message.Experiment != "" && !experimentGridCellsEnabled() {
+		return false
 	}
 	if message.Latitude == 0 && message.Longitude == 0 {
-		return
+		return false
 	}
+	return acceptLocationQuality(messageLocationQuality(message))
+}
 
-	// Iterate gateways. We store it flat in the database
-	for _, gateway := range message.Gateways {
-		gatewayStart := time.Now()
+// aggregateGateway adds a live uplink to the cells of one gateway that heard it, collected in cells. An error is
+// returned if a lookup failed, in which case the message should be retried.
+func aggregateGateway(message types.TtnMapperUplinkMessage, gateway types.TtnMapperGateway, cells *liveCells) error {
+	gatewayStart := time.Now()
 
-		// If the point is too far from the gateway, ignore it
-		if !CheckDistanceFromGateway(gateway, message) {
-			continue
-		}
+	// If the point is too far from the gateway, ignore it
+	if !CheckDistanceFromGateway(gateway, message) {
+		return nil
+	}
+	// Same if the gateway could never have received the signal this strong from that far
+	if !CheckPathLossFromGateway(gateway, message) {
+		return nil
+	}
+
+	// We store coverage data per antenna, assuming antenna index 0 when we don't know the antenna index.
+	antennaIndexer := types.AntennaIndexer{NetworkId: gateway.NetworkId, GatewayId: gateway.GatewayId, AntennaIndex: gateway.AntennaIndex}
+	antennaID, err := getAntennaID(antennaIndexer)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
 
-		var antennaID uint = 0
+	log.Print("AntennaID ", antennaID)
 
-		// We store coverage data per antenna, assuming antenna index 0 when we don't know the antenna index.
-		antennaIndexer := types.AntennaIndexer{NetworkId: gateway.NetworkId, GatewayId: gateway.GatewayId, AntennaIndex: gateway.AntennaIndex}
-		i, ok := antennaDbCache.Load(antennaIndexer)
-		if ok {
-			log.Println("Antenna from cache", antennaIndexer)
-			antennaID = i.(uint)
-		} else {
-			antennaDb := types.Antenna{NetworkId: gateway.NetworkId, GatewayId: gateway.GatewayId, AntennaIndex: gateway.AntennaIndex}
-			log.Println("Antenna from db", antennaDb)
-			err := db.FirstOrCreate(&antennaDb, &antennaDb).Error
-			if err != nil {
-				log.Println(err.Error())
-				continue
-			}
-			antennaID = antennaDb.ID
-			antennaDbCache.Store(antennaIndexer, antennaDb.ID)
-		}
-
-		seconds := message.Time / 1000000000
-		nanos := message.Time % 1000000000
-		entryTime := time.Unix(seconds, nanos)
-
-		log.Print("AntennaID ", antennaID)
-		gridCell, err := getGridCell(antennaID, message.Latitude, message.Longitude)
+	entryTime := uplinkTime(message)
+	err = aggregateLiveCells(antennaID, message, func(buckets *types.SignalBuckets) {
+		incrementBucket(buckets, entryTime, gateway.Rssi, gatewaySignalRssi(gateway), gateway.Snr)
+	}, cells)
+	if err != nil {
+		return err
+	}
+	cells.mutex.Lock()
+	cells.accepted = true
+	cells.mutex.Unlock()
+
+	// Prometheus stats
+	gatewayElapsed := time.Since(gatewayStart)
+	processLiveDuration.Observe(float64(gatewayElapsed.Nanoseconds()) / 1000.0 / 1000.0) //nanoseconds to milliseconds
+
+	return nil
+}
+
+// getAntennaID returns the ID of an antenna, creating the antenna if it is new
+func getAntennaID(antennaIndexer types.AntennaIndexer) (uint, error) {
+	i, ok := antennaDbCache.Get(antennaIndexer)
+	if ok {
+		log.Println("Antenna from cache", antennaIndexer)
+		return i, nil
+	}
+
+	antennaDb := types.Antenna{NetworkId: antennaIndexer.NetworkId, GatewayId: antennaIndexer.GatewayId, AntennaIndex: antennaIndexer.AntennaIndex}
+	log.Println("Antenna from db", antennaDb)
+	err := db.FirstOrCreate(&antennaDb, &antennaDb).Error
+	if err != nil {
+		return 0, err
+	}
+	antennaDbCache.Set(antennaIndexer, antennaDb.ID)
+	return antennaDb.ID, nil
+}
+
+// aggregateLiveCells applies increment to every cell of the antenna containing the location of the uplink, and adds
+// the result to cells.
+func aggregateLiveCells(antennaID uint, message types.TtnMapperUplinkMessage, increment func(buckets *types.SignalBuckets), cells *liveCells) error {
+	dimensions, err := messageDimensions(message)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	// The cells only contain this packet, and are added to the counts already in the database
+	updatedCells := gridCellMap{}
+	updatedPeriodCells := periodGridCellMap{}
+	if tileAggregationEnabled() {
+		// Tiles do not cover the poles, but H3 cells do, so only skip the tiles
+		gridCells, _ := getGridCells(antennaID, message.Latitude, message.Longitude, dimensions)
+		for i := range gridCells {
+			increment(&gridCells[i].SignalBuckets)
+		}
+		gridCells = smearGridCells(gridCells, message.Latitude, message.Longitude, messageLocationQuality(message).AccuracyMeters)
+		for _, gridCell := range gridCells {
+			updatedCells.add(gridCell)
+		}
+		if periodGridCellsEnabled() {
+			addPeriodGridCells(updatedPeriodCells, gridCells, uplinkTime(message))
+		}
+	}
+
+	updatedH3Cells := h3CellMap{}
+	if h3AggregationEnabled() {
+		h3Cells, err := getH3Cells(antennaID, message.Latitude, message.Longitude, dimensions)
 		if err != nil {
-			continue
+			log.Println(err.Error())
+			return err
+		}
+		for _, h3Cell := range h3Cells {
+			increment(&h3Cell.SignalBuckets)
+			updatedH3Cells.add(h3Cell)
 		}
-		incrementBucket(&gridCell, entryTime, gateway.Rssi, gateway.Snr)
-		StoreGridCellInCache(gridCell)
-		StoreGridCellInDb(gridCell)
+	}
+
+	cells.mutex.Lock()
+	for _, gridCell := range updatedCells {
+		cells.gridCells.add(gridCell)
+	}
+	for _, h3Cell := range updatedH3Cells {
+		cells.h3Cells.add(h3Cell)
+	}
+	for _, periodCell := range updatedPeriodCells {
+		cells.periodGridCells.add(periodCell)
+	}
+	cells.mutex.Unlock()
+	return nil
+}
+
+// liveCells collects the increments of all gateways of one live uplink, so that they are added to the database in
+// one go. A retried uplink is then never counted twice by the gateways that succeeded the first time.
+type liveCells struct {
+	mutex               sync.Mutex
+	gridCells           gridCellMap
+	h3Cells             h3CellMap
+	periodGridCells     periodGridCellMap
+	experimentGridCells experimentGridCellMap
+
+	// The antennas that did not hear the uplink are only counted if a gateway that heard it accepted the location
+	accepted         bool
+	noSignal         *liveCells
+	noSignalAntennas int
+}
+
+func newLiveCells() *liveCells {
+	cells := newCellMaps()
+	cells.noSignal = newCellMaps()
+	return cells
+}
+
+func newCellMaps() *liveCells {
+	return &liveCells{
+		gridCells:           gridCellMap{},
+		h3Cells:             h3CellMap{},
+		periodGridCells:     periodGridCellMap{},
+		experimentGridCells: experimentGridCellMap{},
+	}
+}
+
+// addNoSignal adds the no signal increments to the other cells, if any gateway accepted the uplink. It must be
+// called once all gateways are handled.
+func (c *liveCells) addNoSignal() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.accepted {
+		return
+	}
+	c.add(c.noSignal)
+	noSignalUplinks.Add(float64(c.noSignalAntennas))
+	c.noSignal = newCellMaps()
+	c.noSignalAntennas = 0
+}
 
-		// Prometheus stats
-		gatewayElapsed := time.Since(gatewayStart)
-		processLiveDuration.Observe(float64(gatewayElapsed.Nanoseconds()) / 1000.0 / 1000.0) //nanoseconds to milliseconds
+// add sums the cells of other into c. The caller must hold the mutex of c.
+func (c *liveCells) add(other *liveCells) {
+	for _, gridCell := range other.gridCells {
+		c.gridCells.add(gridCell)
 	}
+	for _, h3Cell := range other.h3Cells {
+		c.h3Cells.add(h3Cell)
+	}
+	for _, periodCell := range other.periodGridCells {
+		c.periodGridCells.add(periodCell)
+	}
+	for _, experimentCell := range other.experimentGridCells {
+		c.experimentGridCells.add(experimentCell)
+	}
+}
+
+func (c *liveCells) size() int {
+	return len(c.gridCells) + len(c.h3Cells) + len(c.periodGridCells) + len(c.experimentGridCells)
+}
+
+// antennaIDs returns the antennas with cells in c that a rebuild replaces, in ascending order
+func (c *liveCells) antennaIDs() []uint {
+	seen := map[uint]bool{}
+	for index := range c.gridCells {
+		seen[index.AntennaId] = true
+	}
+	for index := range c.h3Cells {
+		seen[index.AntennaId] = true
+	}
+	for index := range c.periodGridCells {
+		seen[index.AntennaId] = true
+	}
+	antennaIDs := make([]uint, 0, len(seen))
+	for antennaID := range seen {
+		antennaIDs = append(antennaIDs, antennaID)
+	}
+	sort.Slice(antennaIDs, func(i, j int) bool { return antennaIDs[i] < antennaIDs[j] })
+	return antennaIDs
+}
+
+// Increment adds the collected cells to the ones in the database. It waits for rebuilds of the antennas to finish, so
+// that the increments are neither wiped out by the rebuild nor added on top of the packets the rebuild counted.
+func (c *liveCells) Increment(tx *gorm.DB) error {
+	if err := lockAntennasShared(tx, c.antennaIDs()); err != nil {
+		return err
+	}
+	if err := incrementCellsInDb(tx, c.gridCells); err != nil {
+		return err
+	}
+	if err := incrementCellsInDb(tx, c.periodGridCells); err != nil {
+		return err
+	}
+	if err := incrementCellsInDb(tx, c.experimentGridCells); err != nil {
+		return err
+	}
+	return incrementCellsInDb(tx, c.h3Cells)
 }
 
-func aggregateMovedGateway(movedGateway types.TtnMapperGatewayMoved) {
+func aggregateMovedGateway(movedGateway types.TtnMapperGatewayMoved) error {
 
 	processedMoved.Inc()
 
@@ -88,7 +294,7 @@ func aggregateMovedGateway(movedGateway types.TtnMapperGatewayMoved) {
 		NetworkId: movedGateway.NetworkId,
 		GatewayId: movedGateway.GatewayId,
 	}
-	gatewayDbCache.Delete(gatewayIndexer)
+	forgetGateway(gatewayIndexer)
 
 	var movedTime time.Time
 	lastMovedQuery := `
@@ -107,127 +313,300 @@ WHERE gateway_id = ?`
 	}
 
 	for _, antenna := range antennas {
-		ReprocessAntenna(antenna, movedTime)
+		// TTN antennas can belong to other network IDs than the message, and are rebuilt from their own location
+		forgetGateway(types.GatewayIndexer{NetworkId: antenna.NetworkId, GatewayId: antenna.GatewayId})
+		if err := ReprocessAntenna(antenna, movedTime); err != nil {
+			return err
+		}
 	}
 
+	return nil
 }
 
-func ReprocessAntenna(antenna types.Antenna, installedAtLocation time.Time) {
+// ReprocessAntenna rebuilds the cells of an antenna from all the packets it received, each checked against where its
+// gateway was at the time. Uplinks it did not hear only count since installedAtLocation, the time its gateway moved
+// to the current location, and not before the first packet it heard.
+func ReprocessAntenna(antenna types.Antenna, installedAtLocation time.Time) error {
 	antennaStart := time.Now()
 
 	log.Print("AntennaID ", antenna.ID)
 
-	// Get a list of grid cells to delete
-	var gridCells []types.GridCell
-	db.Where("antenna_id = ?", antenna.ID).Find(&gridCells)
+	// Write out pending live increments first, so that they are not added on top of the rebuilt cells afterwards
+	if err := gridCellWriteBuffer.Flush(); err != nil {
+		return err
+	}
 
-	// Remove from local cache
-	for _, gridCell := range gridCells {
-		deletedGridCells.Inc()
-		gridCellIndexer := types.GridCellIndexer{AntennaId: gridCell.AntennaID, X: gridCell.X, Y: gridCell.Y}
-		gridCellDbCache.Delete(gridCellIndexer)
+	// The packets are read in the same snapshot as the old cells are replaced in, while no instance adds to the cells
+	// of the antenna. Readers never see the antenna without coverage, and a failure leaves the old cells in place.
+	var deleted int64
+	err := withAntennaLocked(antenna.ID, func() error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			deleted, err = rebuildAntenna(tx, antenna, installedAtLocation)
+			return err
+		}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	})
+	if err != nil {
+		return err
 	}
+	deletedGridCells.Add(float64(deleted))
+
+	// Prometheus stats
+	antennaElapsed := time.Since(antennaStart)
+	processMovedDuration.Observe(float64(antennaElapsed.Nanoseconds()) / 1000.0 / 1000.0) //nanoseconds to milliseconds
+
+	return nil
+}
 
-	gatewayGridCells := map[types.GridCellIndexer]types.GridCell{}
+// rebuildAntenna replaces the cells of the antenna with ones counted from its packets, and returns how many cells
+// were deleted
+func rebuildAntenna(tx *gorm.DB, antenna types.Antenna, installedAtLocation time.Time) (int64, error) {
+	cells := newAntennaCells(antenna)
 
-	// Get all existing packets since gateway last moved
-	rows, err := db.Model(&types.Packet{}).Where("antenna_id = ? AND time > ? AND experiment_id IS NULL", antenna.ID, installedAtLocation).Rows() // server side cursor
+	// Get all existing packets of the antenna
+	rows, err := tx.Model(&types.Packet{}).Where("antenna_id = ? AND experiment_id IS NULL", antenna.ID).Rows() // server side cursor
 	if err != nil {
-		log.Fatalf(err.Error())
+		return 0, err
 	}
 
 	i := 0
+	var firstHeard time.Time
 	for rows.Next() {
+		if isStopping() {
+			rows.Close()
+			return 0, errShuttingDown
+		}
 		i++
 		oldDataProcessed.Inc()
 		fmt.Printf("\rPacket %d   ", i)
 
 		var packet types.Packet
-		err := db.ScanRows(rows, &packet)
+		err := tx.ScanRows(rows, &packet)
 		if err != nil {
 			log.Println(err.Error())
 			continue
 		}
+		if firstHeard.IsZero() || packet.Time.Before(firstHeard) {
+			firstHeard = packet.Time
+		}
+
+		// Leave out the same points as the live path
+		accept, err := acceptPacketLocationQuality(packet)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !accept {
+			continue
+		}
+		blocked, err := packetDeviceBlocked(packet)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if blocked {
+			continue
+		}
 
 		// If the point is too far from the gateway, ignore it
 		if !CheckDistanceFromAntenna(antenna, packet) {
 			continue
 		}
-
-		gridCell, err := getGridCellNotDb(antenna.ID, packet.Latitude, packet.Longitude) // Do not create now as we will do a batch insert later
+		plausible, err := CheckPathLossFromAntenna(antenna, packet)
 		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !plausible {
 			continue
 		}
-		incrementBucket(&gridCell, packet.Time, packet.Rssi, packet.Snr)
-		StoreGridCellInCache(gridCell) // so that we don't read it again from the database
 
-		// Also store in a map of gridcells we will write to the database later
-		gridCellIndexer := types.GridCellIndexer{AntennaId: gridCell.AntennaID, X: gridCell.X, Y: gridCell.Y}
-		gatewayGridCells[gridCellIndexer] = gridCell
+		// Sum up in maps of cells we will write to the database later
+		if err := cells.Add(packet, false); err != nil {
+			rows.Close()
+			return 0, err
+		}
 	}
 	err = rows.Close()
 	if err != nil {
 		log.Println(err.Error())
 	}
 
-	// Delete old cells from database
-	db.Where(&types.GridCell{AntennaID: antenna.ID}).Delete(&types.GridCell{})
+	// Before the antenna heard its first packet, it was likely not installed yet, and uplinks it did not hear are no
+	// evidence of missing coverage. This also keeps the search for them from going through the whole network history.
+	if myConfiguration.NoSignalEnabled && !firstHeard.IsZero() {
+		since := installedAtLocation
+		if firstHeard.After(since) {
+			since = firstHeard
+		}
+		if err := reprocessNoSignal(tx, antenna, since, cells); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := cells.h3Cells.Resolve(); err != nil {
+		return 0, err
+	}
 
-	if len(gatewayGridCells) == 0 {
+	if len(cells.gridCells) == 0 {
 		log.Println("No packets")
-		return
+	} else {
+		fmt.Println()
+		log.Printf("Result is %d grid cells", len(cells.gridCells))
+	}
+	if periodGridCellsEnabled() {
+		log.Printf("Result is %d period grid cells", len(cells.periodGridCells))
+	}
+	if h3AggregationEnabled() {
+		log.Printf("Result is %d h3 cells", len(cells.h3Cells.h3Cells))
 	}
-	fmt.Println()
 
-	// Then add new ones
-	log.Printf("Result is %d grid cells", len(gatewayGridCells))
-	err = StoreGridCellsInDb(gatewayGridCells)
-	if err != nil {
-		log.Fatalf(err.Error())
+	return cells.Store(tx)
+}
+
+// antennaCells sums up all cells of one antenna while it is rebuilt
+type antennaCells struct {
+	antenna         types.Antenna
+	gridCells       gridCellMap
+	periodGridCells periodGridCellMap
+	h3Cells         *h3Batch
+}
+
+func newAntennaCells(antenna types.Antenna) *antennaCells {
+	return &antennaCells{
+		antenna:         antenna,
+		gridCells:       gridCellMap{},
+		periodGridCells: periodGridCellMap{},
+		h3Cells:         newH3Batch(antenna.ID),
 	}
+}
 
-	// Prometheus stats
-	antennaElapsed := time.Since(antennaStart)
-	processMovedDuration.Observe(float64(antennaElapsed.Nanoseconds()) / 1000.0 / 1000.0) //nanoseconds to milliseconds
+// Add counts a packet the antenna heard, or with noSignal set, a packet it did not hear
+func (c *antennaCells) Add(packet types.Packet, noSignal bool) error {
+	if h3AggregationEnabled() {
+		var err error
+		if noSignal {
+			err = c.h3Cells.AddNoSignal(packet)
+		} else {
+			err = c.h3Cells.Add(packet)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !tileAggregationEnabled() {
+		return nil
+	}
+	dimensions, err := packetDimensions(packet)
+	if err != nil {
+		return err
+	}
+	gridCells, err := getGridCells(c.antenna.ID, packet.Latitude, packet.Longitude, dimensions)
+	if err != nil {
+		return nil
+	}
+	for i := range gridCells {
+		if noSignal {
+			incrementNoSignal(&gridCells[i].SignalBuckets, packet.Time)
+		} else {
+			incrementBucket(&gridCells[i].SignalBuckets, packet.Time, packet.Rssi, packet.SignalRssi, packet.Snr)
+		}
+	}
+	gridCells = smearGridCells(gridCells, packet.Latitude, packet.Longitude, packet.AccuracyMeters)
+	for _, gridCell := range gridCells {
+		c.gridCells.add(gridCell)
+	}
+	if periodGridCellsEnabled() {
+		addPeriodGridCells(c.periodGridCells, gridCells, packet.Time)
+	}
+	return nil
 }
 
-func getGridCell(antennaId uint, latitude float64, longitude float64) (types.GridCell, error) {
-	// https://blog.jochentopf.com/2013-02-04-antarctica-in-openstreetmap.html
-	// The Mercator projection generally used in online maps only covers the area between about 85.0511 degrees South and 85.0511 degrees North.
-	if latitude < -85 || latitude > 85 {
-		// We get a tile index that is invalid if we try handling -90,-180
-		return types.GridCell{}, errors.New("coordinates out of range")
+// Store replaces the cells of the antenna in the database with the summed up ones, and returns how many were deleted
+func (c *antennaCells) Store(tx *gorm.DB) (int64, error) {
+	var deleted int64
+
+	if tileAggregationEnabled() {
+		result := tx.Where(&types.GridCell{AntennaID: c.antenna.ID}).Delete(&types.GridCell{})
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		deleted += result.RowsAffected
+
+		if err := storeCellsInDb(tx, c.gridCells); err != nil {
+			return 0, err
+		}
 	}
-	if latitude == 0 && longitude == 0 {
-		// We get a tile index that is invalid if we try handling -90,-180
-		return types.GridCell{}, errors.New("null island")
+
+	if periodGridCellsEnabled() {
+		result := tx.Where(&types.PeriodGridCell{AntennaID: c.antenna.ID}).Delete(&types.PeriodGridCell{})
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		deleted += result.RowsAffected
+
+		if err := storeCellsInDb(tx, c.periodGridCells); err != nil {
+			return 0, err
+		}
 	}
 
-	tile := gosm.NewTileWithLatLong(latitude, longitude, 19)
+	if h3AggregationEnabled() {
+		result := tx.Where(&types.H3Cell{AntennaID: c.antenna.ID}).Delete(&types.H3Cell{})
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		deleted += result.RowsAffected
 
-	gridCellDb := types.GridCell{}
+		if err := storeCellsInDb(tx, c.h3Cells.h3Cells); err != nil {
+			return 0, err
+		}
+	}
 
-	// Try and find in cache first
-	gridCellIndexer := types.GridCellIndexer{AntennaId: antennaId, X: tile.X, Y: tile.Y}
-	i, ok := gridCellDbCache.Load(gridCellIndexer)
-	if ok {
-		gridCellDb = i.(types.GridCell)
-		//log.Print("Found grid cell in cache")
-	} else {
-		gridCellDb.AntennaID = antennaId
-		gridCellDb.X = tile.X
-		gridCellDb.Y = tile.Y
-		err := db.FirstOrCreate(&gridCellDb, &gridCellDb).Error
+	return deleted, nil
+}
+
+// Tiles at zoom 19 are about 75 m wide at the equator, there is no point in cells smaller than the location accuracy
+const maxGridCellZoom = 19
+
+func validateGridCellZoomLevels() error {
+	if tileAggregationEnabled() && len(myConfiguration.GridCellZoomLevels) == 0 {
+		return errors.New("no grid cell zoom levels configured")
+	}
+	seen := map[int]bool{}
+	for _, zoom := range myConfiguration.GridCellZoomLevels {
+		if zoom < 0 || zoom > maxGridCellZoom {
+			return fmt.Errorf("grid cell zoom level %d is not between 0 and %d", zoom, maxGridCellZoom)
+		}
+		if seen[zoom] {
+			return fmt.Errorf("grid cell zoom level %d is configured twice", zoom)
+		}
+		seen[zoom] = true
+	}
+	return nil
+}
+
+// getGridCells returns an empty grid cell for every configured zoom level and every dimension, for the tiles
+// containing the coordinates
+func getGridCells(antennaId uint, latitude float64, longitude float64, dimensions []cellDimension) ([]types.GridCell, error) {
+	gridCells := make([]types.GridCell, 0, len(myConfiguration.GridCellZoomLevels)*len(dimensions))
+	for _, zoom := range myConfiguration.GridCellZoomLevels {
+		gridCell, err := getGridCell(antennaId, latitude, longitude, zoom)
 		if err != nil {
-			log.Print(antennaId, latitude, longitude, tile.X, tile.Y)
-			failOnError(err, "Failed to find db entry for grid cell")
+			return nil, err
+		}
+		for _, dimension := range dimensions {
+			gridCell.DataRateID = dimension.DataRateID
+			gridCell.FrequencyBand = dimension.FrequencyBand
+			gridCells = append(gridCells, gridCell)
 		}
-		//log.Print("Found grid cell in db")
 	}
-	return gridCellDb, nil
+	return gridCells, nil
 }
 
-func getGridCellNotDb(antennaId uint, latitude float64, longitude float64) (types.GridCell, error) {
+// getGridCell returns an empty grid cell for the tile at the given zoom level containing the coordinates. Counts are
+// added to it and then added to the counts already stored, so the current state of the cell is never needed.
+func getGridCell(antennaId uint, latitude float64, longitude float64, zoom int) (types.GridCell, error) {
 	// https://blog.jochentopf.com/2013-02-04-antarctica-in-openstreetmap.html
 	// The Mercator projection generally used in online maps only covers the area between about 85.0511 degrees South and 85.0511 degrees North.
 	if latitude < -85 || latitude > 85 {
@@ -239,154 +618,335 @@ func getGridCellNotDb(antennaId uint, latitude float64, longitude float64) (type
 		return types.GridCell{}, errors.New("null island")
 	}
 
-	tile := gosm.NewTileWithLatLong(latitude, longitude, 19)
+	tile := gosm.NewTileWithLatLong(latitude, longitude, zoom)
 
 	gridCell := types.GridCell{}
+	gridCell.AntennaID = antennaId
+	gridCell.X = tile.X
+	gridCell.Y = tile.Y
+	gridCell.Z = zoom
+	gridCell.BucketSchemaID = bucketSchemaID
+	return gridCell, nil
+}
 
-	// Try and find in cache
-	gridCellIndexer := types.GridCellIndexer{AntennaId: antennaId, X: tile.X, Y: tile.Y}
-	i, ok := gridCellDbCache.Load(gridCellIndexer)
+func gridCellIndex(gridCell types.GridCell) types.GridCellIndexer {
+	return types.GridCellIndexer{
+		AntennaId:     gridCell.AntennaID,
+		X:             gridCell.X,
+		Y:             gridCell.Y,
+		Z:             gridCell.Z,
+		DataRateId:    gridCell.DataRateID,
+		FrequencyBand: gridCell.FrequencyBand,
+	}
+}
+
+type gridCellMap map[types.GridCellIndexer]types.GridCell
+
+// add sums the counts of gridCell into the cell with the same index
+func (m gridCellMap) add(gridCell types.GridCell) {
+	gridCellIndexer := gridCellIndex(gridCell)
+	existing, ok := m[gridCellIndexer]
 	if ok {
-		gridCell = i.(types.GridCell)
-		//log.Print("Found grid cell in cache")
+		addSignalBuckets(&existing.SignalBuckets, gridCell.SignalBuckets)
+		m[gridCellIndexer] = existing
 	} else {
-		gridCell.AntennaID = antennaId
-		gridCell.X = tile.X
-		gridCell.Y = tile.Y
+		m[gridCellIndexer] = gridCell
 	}
-	return gridCell, nil
 }
 
-func StoreGridCellInCache(gridCell types.GridCell) {
-	// Save to cache
-	gridCellIndexer := types.GridCellIndexer{AntennaId: gridCell.AntennaID, X: gridCell.X, Y: gridCell.Y}
-	gridCellDbCache.Store(gridCellIndexer, gridCell)
+func (m gridCellMap) table() cellTable { return gridCellTable }
+func (m gridCellMap) size() int        { return len(m) }
+
+func (m gridCellMap) sorted() interface{} {
+	gridCells := make([]types.GridCell, 0, len(m))
+	for _, gridCell := range m {
+		gridCells = append(gridCells, gridCell)
+	}
+
+	sort.Slice(gridCells, func(i, j int) bool {
+		a, b := gridCells[i], gridCells[j]
+		if a.AntennaID != b.AntennaID {
+			return a.AntennaID < b.AntennaID
+		}
+		if a.Z != b.Z {
+			return a.Z < b.Z
+		}
+		if a.X != b.X {
+			return a.X < b.X
+		}
+		if a.Y != b.Y {
+			return a.Y < b.Y
+		}
+		if a.DataRateID != b.DataRateID {
+			return a.DataRateID < b.DataRateID
+		}
+		return a.FrequencyBand < b.FrequencyBand
+	})
+	return &gridCells
 }
 
-//func StoreGridCellInTempCache(tempCache *sync.Map, gridCell types.GridCell) {
-//	// Save to cache
-//	gridCellIndexer := types.GridCellIndexer{AntennaId: gridCell.AntennaID, X: gridCell.X, Y: gridCell.Y}
-//	tempCache.Store(gridCellIndexer, gridCell)
-//}
+// addSignalBuckets adds the counts of delta to buckets. This is the in memory equivalent of incrementAssignments.
+func addSignalBuckets(buckets *types.SignalBuckets, delta types.SignalBuckets) {
+	buckets.BucketHigh += delta.BucketHigh
+	buckets.Bucket100 += delta.Bucket100
+	buckets.Bucket105 += delta.Bucket105
+	buckets.Bucket110 += delta.Bucket110
+	buckets.Bucket115 += delta.Bucket115
+	buckets.Bucket120 += delta.Bucket120
+	buckets.Bucket125 += delta.Bucket125
+	buckets.Bucket130 += delta.Bucket130
+	buckets.Bucket135 += delta.Bucket135
+	buckets.Bucket140 += delta.Bucket140
+	buckets.Bucket145 += delta.Bucket145
+	buckets.BucketLow += delta.BucketLow
+	buckets.BucketNoSignal += delta.BucketNoSignal
+
+	addSignalWeights(buckets, delta)
+	if delta.LastUpdated.After(buckets.LastUpdated) {
+		buckets.LastUpdated = delta.LastUpdated
+	}
 
-func StoreGridCellInDb(gridCell types.GridCell) {
-	// Save to db
-	//log.Println("Storing in DB")
-	//log.Println(gridCellDb)
-	db.Save(&gridCell)
+	addSignalStatistics(&buckets.SignalStatistics, delta.SignalStatistics)
 }
 
-func StoreGridCellsInDb(gridCells map[types.GridCellIndexer]types.GridCell) error {
-	if len(gridCells) == 0 {
-		log.Println("No grid cells to insert")
+// addSignalStatistics merges the statistics of delta into statistics. Pointers are copied, so that the cells never
+// share them.
+func addSignalStatistics(statistics *types.SignalStatistics, delta types.SignalStatistics) {
+	statistics.SignalCount += delta.SignalCount
+	statistics.RssiSum += delta.RssiSum
+	statistics.RssiSumSquares += delta.RssiSumSquares
+	statistics.SnrSum += delta.SnrSum
+	statistics.SnrSumSquares += delta.SnrSumSquares
+
+	statistics.RssiMin = minFloat32(statistics.RssiMin, delta.RssiMin)
+	statistics.RssiMax = maxFloat32(statistics.RssiMax, delta.RssiMax)
+	statistics.SnrMin = minFloat32(statistics.SnrMin, delta.SnrMin)
+	statistics.SnrMax = maxFloat32(statistics.SnrMax, delta.SnrMax)
+
+	if delta.FirstSeen != nil && (statistics.FirstSeen == nil || delta.FirstSeen.Before(*statistics.FirstSeen)) {
+		firstSeen := *delta.FirstSeen
+		statistics.FirstSeen = &firstSeen
+	}
+}
+
+// minFloat32 returns a copy of the lowest value, ignoring nil like LEAST does in Postgres
+func minFloat32(a *float32, b *float32) *float32 {
+	if b == nil || (a != nil && *a <= *b) {
+		return a
+	}
+	value := *b
+	return &value
+}
+
+// maxFloat32 returns a copy of the highest value, ignoring nil like GREATEST does in Postgres
+func maxFloat32(a *float32, b *float32) *float32 {
+	if b == nil || (a != nil && *a >= *b) {
+		return a
+	}
+	value := *b
+	return &value
+}
+
+// incrementAssignments returns the upsert assignments that add the signal buckets of the new row to the existing row
+// in table
+func incrementAssignments(table string) clause.Set {
+	assignments := clause.Set{{
+		Column: clause.Column{Name: "last_updated"},
+		Value:  gorm.Expr("GREATEST(" + table + ".last_updated, excluded.last_updated)"),
+	}}
+	for _, column := range signalBucketColumns {
+		assignments = append(assignments, clause.Assignment{
+			Column: clause.Column{Name: column},
+			Value:  gorm.Expr(table + "." + column + " + excluded." + column),
+		})
+	}
+	for _, column := range signalLeastColumns {
+		assignments = append(assignments, clause.Assignment{
+			Column: clause.Column{Name: column},
+			Value:  gorm.Expr("LEAST(" + table + "." + column + ", excluded." + column + ")"),
+		})
+	}
+	for _, column := range signalGreatestColumns {
+		assignments = append(assignments, clause.Assignment{
+			Column: clause.Column{Name: column},
+			Value:  gorm.Expr("GREATEST(" + table + "." + column + ", excluded." + column + ")"),
+		})
+	}
+	if weightsEnabled() {
+		assignments = append(assignments, decayAssignments(table)...)
+	}
+	return assignments
+}
+
+// cellMap sums up the cells of one table in memory, by their key
+type cellMap interface {
+	table() cellTable
+	size() int
+	// sorted returns a pointer to a slice of the cells, ordered by their key, so that concurrent bulk upserts lock
+	// rows in the same order and can not deadlock each other
+	sorted() interface{}
+}
+
+// cellTable is a table of cells and the columns of its unique key
+type cellTable struct {
+	name       string
+	keyColumns []clause.Column
+}
+
+// incrementCellsInDb adds the counts of the given cells to the ones in the database, creating cells that do not exist
+// yet. This is done in a single upsert, so concurrent updates from other processes are never lost. Pass the
+// transaction to use, or the global db.
+func incrementCellsInDb(tx *gorm.DB, cells cellMap) error {
+	if cells.size() == 0 {
 		return nil
 	}
 
-	gridCellsSlice := make([]types.GridCell, 0)
-	for _, val := range gridCells {
-		gridCellsSlice = append(gridCellsSlice, val)
+	table := cells.table()
+	tx = tx.Clauses(clause.OnConflict{
+		Columns:   table.keyColumns,
+		DoUpdates: incrementAssignments(table.name),
+		Where:     sameBucketSchema(table.name),
+	}).Create(cells.sorted())
+	if tx.Error != nil {
+		return tx.Error
+	}
+	countBucketSchemaSkipped(cells.size(), tx.RowsAffected)
+	return nil
+}
+
+// sameBucketSchema limits an increment upsert to existing rows counted with the same bucket schema
+func sameBucketSchema(table string) clause.Where {
+	return clause.Where{Exprs: []clause.Expression{
+		clause.Expr{SQL: table + ".bucket_schema_id = excluded.bucket_schema_id"},
+	}}
+}
+
+// countBucketSchemaSkipped records the rows of an increment upsert that were not written due to a different schema
+func countBucketSchemaSkipped(rows int, rowsAffected int64) {
+	skipped := int64(rows) - rowsAffected
+	if skipped > 0 {
+		log.Printf("Skipped %d cell updates with a different bucket schema, rebuild their antennas", skipped)
+		bucketSchemaSkipped.Add(float64(skipped))
+	}
+}
+
+// storeCellsInDb writes the given cells, overwriting the counts of cells that already exist. Pass the transaction to
+// use, or the global db.
+func storeCellsInDb(tx *gorm.DB, cells cellMap) error {
+	if cells.size() == 0 {
+		return nil
 	}
 
 	// On conflict override
-	tx := db.Clauses(clause.OnConflict{
+	tx = tx.Clauses(clause.OnConflict{
+		Columns:   cells.table().keyColumns,
 		UpdateAll: true,
-	}).Create(&gridCellsSlice)
+	}).Create(cells.sorted())
 	return tx.Error
 }
 
-func incrementBucket(gridCell *types.GridCell, time time.Time, rssi float32, snr float32) {
-	signal := rssi
-	if snr < 0 {
-		signal += snr
-	}
-
-	if signal > -95 {
-		gridCell.BucketHigh++
-	} else if signal > -100 {
-		gridCell.Bucket100++
-	} else if signal > -105 {
-		gridCell.Bucket105++
-	} else if signal > -110 {
-		gridCell.Bucket110++
-	} else if signal > -115 {
-		gridCell.Bucket115++
-	} else if signal > -120 {
-		gridCell.Bucket120++
-	} else if signal > -125 {
-		gridCell.Bucket125++
-	} else if signal > -130 {
-		gridCell.Bucket130++
-	} else if signal > -135 {
-		gridCell.Bucket135++
-	} else if signal > -140 {
-		gridCell.Bucket140++
-	} else if signal > -145 {
-		gridCell.Bucket145++
-	} else {
-		gridCell.BucketLow++
+// incrementBucket counts a packet in the band of the configured bucket schema its signal level falls in, and adds it
+// to the signal statistics
+func incrementBucket(buckets *types.SignalBuckets, time time.Time, rssi float32, signalRssi *float32, snr float32) {
+	signal := signalLevel(rssi, signalRssi, snr)
+	bands := signalBands(buckets)
+	band := len(myConfiguration.SignalBucketEdges) // weaker than the last edge
+	for i, edge := range myConfiguration.SignalBucketEdges {
+		if float64(signal) > edge {
+			band = i
+			break
+		}
+	}
+	*bands[band]++
+
+	addDecayedWeight(buckets, band, time)
+	if time.After(buckets.LastUpdated) {
+		buckets.LastUpdated = time
 	}
 
-	if time.After(gridCell.LastUpdated) {
-		gridCell.LastUpdated = time
+	addSignalStatistics(&buckets.SignalStatistics, types.SignalStatistics{
+		FirstSeen:      &time,
+		SignalCount:    1,
+		RssiSum:        float64(rssi),
+		RssiSumSquares: float64(rssi) * float64(rssi),
+		RssiMin:        &rssi,
+		RssiMax:        &rssi,
+		SnrSum:         float64(snr),
+		SnrSumSquares:  float64(snr) * float64(snr),
+		SnrMin:         &snr,
+		SnrMax:         &snr,
+	})
+
+	updatedGridCells.Inc()
+}
+
+// incrementNoSignal counts an uplink that was not heard
+func incrementNoSignal(buckets *types.SignalBuckets, time time.Time) {
+	buckets.BucketNoSignal++
+
+	addDecayedWeight(buckets, len(signalWeightColumns)-1, time) // no signal is the last weight
+	if time.After(buckets.LastUpdated) {
+		buckets.LastUpdated = time
 	}
 
 	updatedGridCells.Inc()
 }
 
+// uplinkTime converts the nanosecond timestamp of an uplink message
+func uplinkTime(message types.TtnMapperUplinkMessage) time.Time {
+	seconds := message.Time / 1000000000
+	nanos := message.Time % 1000000000
+	return time.Unix(seconds, nanos)
+}
+
 func CheckDistanceFromAntenna(antenna types.Antenna, packet types.Packet) bool {
 
 	gateway := types.TtnMapperGateway{NetworkId: antenna.NetworkId, GatewayId: antenna.GatewayId}
-	message := types.TtnMapperUplinkMessage{Latitude: packet.Latitude, Longitude: packet.Longitude}
+	message := types.TtnMapperUplinkMessage{Latitude: packet.Latitude, Longitude: packet.Longitude, Time: packet.Time.UnixNano()}
 
 	return CheckDistanceFromGateway(gateway, message)
 }
 
 func CheckDistanceFromGateway(gateway types.TtnMapperGateway, message types.TtnMapperUplinkMessage) bool {
-	var gatewayDb types.Gateway
+	km, ok := gatewayDistanceKm(gateway, message)
+	if !ok {
+		return false
+	}
+
+	gatewayIndexer := types.GatewayIndexer{NetworkId: gateway.NetworkId, GatewayId: gateway.GatewayId}
+	maximumRangeKm, err := gatewayMaximumRangeKm(gatewayIndexer)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	return km <= maximumRangeKm
+}
 
+// gatewayDistanceKm returns the distance of the point from the location of the gateway at the time of the uplink. It
+// is not ok if the gateway location is unknown or blacklisted.
+func gatewayDistanceKm(gateway types.TtnMapperGateway, message types.TtnMapperUplinkMessage) (float64, bool) {
 	// Find the gateway so that we can check the distance of this point from the gateway
 	gatewayIndexer := types.GatewayIndexer{
 		NetworkId: gateway.NetworkId,
 		GatewayId: gateway.GatewayId,
 	}
-	i, ok := gatewayDbCache.Load(gatewayIndexer)
-	if ok {
-		//log.Println("Gateway from cache")
-		gatewayDb = i.(types.Gateway)
-	} else {
-		gatewayDb = types.Gateway{NetworkId: gateway.NetworkId, GatewayId: gateway.GatewayId}
-		//log.Println("Gateway from DB")
-		err := db.First(&gatewayDb, &gatewayDb).Error
-		if err != nil {
-			log.Println(err.Error())
-			return false // if we can't find the gateway, rather do not allow this point through
-		}
-		if gatewayDb.ID != 0 {
-			gatewayDbCache.Store(gatewayIndexer, gatewayDb)
-		}
-	}
-
-	gatewayLatitude := 0.0
-	if gatewayDb.Latitude != nil {
-		gatewayLatitude = *gatewayDb.Latitude
+	locationTime := uplinkTime(message)
+	if message.Time == 0 {
+		locationTime = time.Now()
 	}
-	gatewayLongitude := 0.0
-	if gatewayDb.Longitude != nil {
-		gatewayLongitude = *gatewayDb.Longitude
+	gatewayLatitude, gatewayLongitude, err := gatewayLocation(gatewayIndexer, locationTime)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, false // if we can't find the gateway, rather do not allow this point through
 	}
 
 	if gatewayLatitude == 0 && gatewayLongitude == 0 {
-		// Null island, exclude gateways with unknown locations
-		return false
-	} else {
-		oldLocation := haversine.Coord{Lat: gatewayLatitude, Lon: gatewayLongitude}
-		newLocation := haversine.Coord{Lat: message.Latitude, Lon: message.Longitude}
-		_, km := haversine.Distance(oldLocation, newLocation)
-
-		if km > myConfiguration.GatewayMaximumRangeKm {
-			return false
-		} else {
-			return true
-		}
+		// Null island, exclude gateways with unknown locations, and blacklisted gateways
+		return 0, false
 	}
+
+	oldLocation := haversine.Coord{Lat: gatewayLatitude, Lon: gatewayLongitude}
+	newLocation := haversine.Coord{Lat: message.Latitude, Lon: message.Longitude}
+	_, km := haversine.Distance(oldLocation, newLocation)
+	return km, true
 }
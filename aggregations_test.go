@@ -1,8 +1,15 @@
+//go:build integration
+// +build integration
+
+// Needs a database configured in conf.json, run with go test -tags integration
+
 package main
 
 import (
-	"github.com/jinzhu/gorm"
 	"github.com/tkanos/gonfig"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 	"log"
 	"testing"
 	"time"
@@ -17,23 +24,23 @@ func IniDb() {
 
 	//log.Printf("[Configuration]\n%s\n", prettyPrint(myConfiguration)) // output: [UserA, UserB]
 
-	// Table name prefixes
-	gorm.DefaultTableNameHandler = func(db *gorm.DB, defaultTableName string) string {
-		//return "ttnmapper_" + defaultTableName
-		return defaultTableName
+	var gormLogLevel = logger.Silent
+	if myConfiguration.PostgresDebugLog {
+		gormLogLevel = logger.Info
 	}
 
 	var dbErr error
 	// pq: unsupported sslmode "prefer"; only "require" (default), "verify-full", "verify-ca", and "disable" supported - so we disable it
-	db, dbErr = gorm.Open("postgres", "host="+myConfiguration.PostgresHost+" port="+myConfiguration.PostgresPort+" user="+myConfiguration.PostgresUser+" dbname="+myConfiguration.PostgresDatabase+" password="+myConfiguration.PostgresPassword+" sslmode=disable")
+	db, dbErr = gorm.Open(postgres.Open("host="+myConfiguration.PostgresHost+" port="+myConfiguration.PostgresPort+" user="+myConfiguration.PostgresUser+" dbname="+myConfiguration.PostgresDatabase+" password="+myConfiguration.PostgresPassword+" sslmode=disable"), &gorm.Config{
+		Logger: logger.Default.LogMode(gormLogLevel),
+	})
 	if dbErr != nil {
 		log.Println("Error connecting to Postgres")
 		panic(dbErr.Error())
 	}
-	//defer db.Close()
 
-	if myConfiguration.PostgresDebugLog {
-		db.LogMode(true)
+	if err := loadBucketSchema(); err != nil {
+		panic(err.Error())
 	}
 }
 
@@ -85,7 +92,7 @@ AND gateway_id = ?`
 		break
 	}
 	rows.Close()
-	db.Close()
+	closeDatabase()
 }
 
 func TestReprocessHelium(t *testing.T) {
@@ -106,5 +113,5 @@ AND gateway_id = ?`
 		log.Println(antenna.GatewayId, movedTime)
 		ReprocessAntenna(antenna, movedTime)
 	}
-	db.Close()
+	closeDatabase()
 }
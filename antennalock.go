@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"log"
+)
+
+// Rebuilding an antenna replaces all of its cells, so live increments of the antenna must not run at the same time,
+// by any instance. Postgres advisory locks serialise them: increments share the lock of an antenna, a rebuild holds it
+// exclusively. The first key keeps these locks apart from other users of advisory locks in the database.
+const antennaLockNamespace = 0x6772_6964 // "grid"
+
+// lockAntennasShared waits for running rebuilds of the antennas, and keeps new ones from starting until the
+// transaction ends
+func lockAntennasShared(tx *gorm.DB, antennaIDs []uint) error {
+	if len(antennaIDs) == 0 {
+		return nil
+	}
+	// Locked in order of the antenna IDs
+	return tx.Exec(`SELECT pg_advisory_xact_lock_shared(?, locked.id::int) FROM (SELECT id FROM antennas WHERE id IN ? ORDER BY id) AS locked`,
+		antennaLockNamespace, antennaIDs).Error
+}
+
+// withAntennaLocked runs f while holding the exclusive lock of the antenna. The lock is held by a connection of its
+// own, so that f can start its transaction after the running increments have committed, and see them.
+func withAntennaLocked(antennaID uint, f func() error) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1, $2)`, antennaLockNamespace, int32(antennaID)); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1, $2)`, antennaLockNamespace, int32(antennaID)); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	return f()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"github.com/umahmood/haversine"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+var (
+	blockedDeviceDbCache = blockedDeviceCache{newLruCache("blocked_device", 200, time.Duration(myConfiguration.DeviceCacheTtlSeconds)*time.Second)}
+	deviceDbCache        = deviceCache{newLruCache("device", 200, 24*time.Hour)}
+)
+
+// blockedDeviceCache also remembers devices that are not blocked, as an empty value
+type blockedDeviceCache struct {
+	*lruCache
+}
+
+func (c blockedDeviceCache) Get(deviceIndexer types.DeviceIndexer) ([]types.BlockedDevice, bool) {
+	i, ok := c.lruCache.Get(deviceIndexer)
+	if !ok {
+		return nil, false
+	}
+	return i.([]types.BlockedDevice), true
+}
+
+func (c blockedDeviceCache) Set(deviceIndexer types.DeviceIndexer, blocks []types.BlockedDevice) {
+	c.lruCache.Set(deviceIndexer, blocks)
+}
+
+type deviceCache struct {
+	*lruCache
+}
+
+func (c deviceCache) Get(deviceID uint) (types.DeviceIndexer, bool) {
+	i, ok := c.lruCache.Get(deviceID)
+	if !ok {
+		return types.DeviceIndexer{}, false
+	}
+	return i.(types.DeviceIndexer), true
+}
+
+func (c deviceCache) Set(deviceID uint, deviceIndexer types.DeviceIndexer) {
+	c.lruCache.Set(deviceID, deviceIndexer)
+}
+
+// getDeviceBlocks returns the blocks matching a device
+func getDeviceBlocks(deviceIndexer types.DeviceIndexer) ([]types.BlockedDevice, error) {
+	blocks, ok := blockedDeviceDbCache.Get(deviceIndexer)
+	if ok {
+		return blocks, nil
+	}
+
+	query := db.Where("app_id = ? AND dev_id = ? AND dev_id <> ''", deviceIndexer.AppId, deviceIndexer.DevId)
+	if deviceIndexer.DevEui != "" {
+		query = query.Or("dev_eui = ?", deviceIndexer.DevEui)
+	}
+	blocks = []types.BlockedDevice{}
+	if err := query.Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+	blockedDeviceDbCache.Set(deviceIndexer, blocks)
+	return blocks, nil
+}
+
+// blockedAt is whether one of the blocks covers the time
+func blockedAt(blocks []types.BlockedDevice, at time.Time) bool {
+	for _, block := range blocks {
+		if block.BlockedFrom != nil && at.Before(*block.BlockedFrom) {
+			continue
+		}
+		if block.BlockedUntil != nil && !at.Before(*block.BlockedUntil) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// messageDeviceBlocked is whether the device of a live uplink was blocked at the time of the uplink
+func messageDeviceBlocked(message types.TtnMapperUplinkMessage) (bool, error) {
+	deviceIndexer := types.DeviceIndexer{AppId: message.AppID, DevId: message.DevID, DevEui: message.DevEui}
+	blocks, err := getDeviceBlocks(deviceIndexer)
+	if err != nil {
+		return false, err
+	}
+	if blockedAt(blocks, uplinkTime(message)) {
+		rejectedPoints.WithLabelValues(rejectBlockedDevice).Inc()
+		return true, nil
+	}
+	return false, nil
+}
+
+// packetDeviceBlocked is messageDeviceBlocked for a stored packet
+func packetDeviceBlocked(packet types.Packet) (bool, error) {
+	deviceIndexer, ok := deviceDbCache.Get(packet.DeviceID)
+	if !ok {
+		var deviceDb types.Device
+		if err := db.First(&deviceDb, packet.DeviceID).Error; err != nil {
+			return false, err
+		}
+		deviceIndexer = types.DeviceIndexer{AppId: deviceDb.AppId, DevId: deviceDb.DevId, DevEui: deviceDb.DevEui}
+		deviceDbCache.Set(packet.DeviceID, deviceIndexer)
+	}
+
+	blocks, err := getDeviceBlocks(deviceIndexer)
+	if err != nil {
+		return false, err
+	}
+	if blockedAt(blocks, packet.Time) {
+		rejectedPoints.WithLabelValues(rejectBlockedDevice).Inc()
+		return true, nil
+	}
+	return false, nil
+}
+
+// RebuildDevices rebuilds every antenna and experiment with packets of the given devices, after they were blocked or
+// unblocked. Devices are given as a DevEUI or as app_id/dev_id. With no signal counting enabled, the antennas that
+// may have counted the devices as no signal are rebuilt as well.
+func RebuildDevices(devices []string) error {
+	var deviceIDs []uint
+	for _, device := range devices {
+		query := db.Model(&types.Device{}).Where("dev_eui = ?", device)
+		if parts := strings.SplitN(device, "/", 2); len(parts) == 2 {
+			query = db.Model(&types.Device{}).Where("app_id = ? AND dev_id = ?", parts[0], parts[1])
+		}
+		var ids []uint
+		if err := query.Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return errors.New("unknown device " + device)
+		}
+		deviceIDs = append(deviceIDs, ids...)
+	}
+
+	// Live instances only see the change once the blocks they cached expire. Until then they still add packets of
+	// the devices, which would end up on top of the rebuilt cells.
+	deviceCacheTtl := time.Duration(myConfiguration.DeviceCacheTtlSeconds) * time.Second
+	log.Println("Waiting", deviceCacheTtl, "for the blocked device caches of live instances to expire")
+	select {
+	case <-time.After(deviceCacheTtl):
+	case <-stopping:
+		return errShuttingDown
+	}
+
+	var antennas []types.Antenna
+	err := db.Where("id IN (SELECT DISTINCT antenna_id FROM packets WHERE device_id IN ?)", deviceIDs).Order("id").Find(&antennas).Error
+	if err != nil {
+		return err
+	}
+	if myConfiguration.NoSignalEnabled {
+		noSignal, err := deviceNoSignalAntennas(deviceIDs)
+		if err != nil {
+			return err
+		}
+		antennas = mergeAntennas(antennas, noSignal)
+	}
+	for i, antenna := range antennas {
+		if isStopping() {
+			return errShuttingDown
+		}
+		log.Println(i, "/", len(antennas), " ", antenna.NetworkId, " - ", antenna.GatewayId)
+		if err := ReprocessAntenna(antenna, antennaInstalledAt(antenna)); err != nil {
+			return err
+		}
+	}
+
+	if !experimentGridCellsEnabled() {
+		return nil
+	}
+	var experiments []types.Experiment
+	err = db.Where("id IN (SELECT DISTINCT experiment_id FROM packets WHERE device_id IN ?)", deviceIDs).Order("id").Find(&experiments).Error
+	if err != nil {
+		return err
+	}
+	for _, experiment := range experiments {
+		if isStopping() {
+			return errShuttingDown
+		}
+		if err := ReprocessExperiment(experiment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Packet locations are rounded to this many decimals when searching for no signal antennas, which moves them by up to
+// deviceLocationSlackKm
+const (
+	deviceLocationDecimals = 3
+	deviceLocationSlackKm  = 0.1
+)
+
+// deviceNoSignalAntennas returns the antennas that may have counted packets of the devices as no signal: the ones in
+// a network that received the packets, with a packet within their range. Like reprocessNoSignal, the current gateway
+// locations are used.
+func deviceNoSignalAntennas(deviceIDs []uint) ([]types.Antenna, error) {
+	locationsQuery := `
+SELECT DISTINCT antennas.network_id, round(packets.latitude, ?), round(packets.longitude, ?)
+FROM packets
+JOIN antennas ON antennas.id = packets.antenna_id
+WHERE packets.device_id IN ?
+AND packets.experiment_id IS NULL`
+	rows, err := db.Raw(locationsQuery, deviceLocationDecimals, deviceLocationDecimals, deviceIDs).Rows()
+	if err != nil {
+		return nil, err
+	}
+	locations := map[string][]haversine.Coord{}
+	for rows.Next() {
+		var networkId string
+		var location haversine.Coord
+		if err := rows.Scan(&networkId, &location.Lat, &location.Lon); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if location.Lat == 0 && location.Lon == 0 {
+			continue
+		}
+		locations[networkId] = append(locations[networkId], location)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	var antennas []types.Antenna
+	for networkId, networkLocations := range locations {
+		rangeKm, err := networksMaximumRangeKm([]string{networkId})
+		if err != nil {
+			return nil, err
+		}
+
+		// Search the box containing the ranges around all locations, and check the exact distances afterwards
+		index := newLocationIndex(networkLocations, rangeKm+deviceLocationSlackKm)
+		minLatitude, maxLatitude, minLongitude, maxLongitude := boundingBox(networkLocations[0].Lat, networkLocations[0].Lon, rangeKm+deviceLocationSlackKm)
+		for _, location := range networkLocations[1:] {
+			south, north, west, east := boundingBox(location.Lat, location.Lon, rangeKm+deviceLocationSlackKm)
+			minLatitude, maxLatitude = math.Min(minLatitude, south), math.Max(maxLatitude, north)
+			minLongitude, maxLongitude = math.Min(minLongitude, west), math.Max(maxLongitude, east)
+		}
+
+		var candidates []types.Antenna
+		err = db.Select("antennas.*").
+			Joins("JOIN gateways ON gateways.network_id = antennas.network_id AND gateways.gateway_id = antennas.gateway_id").
+			Where("antennas.network_id = ?", networkId).
+			Where("gateways.latitude BETWEEN ? AND ?", minLatitude, maxLatitude).
+			Where("gateways.longitude BETWEEN ? AND ?", minLongitude, maxLongitude).
+			Find(&candidates).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, antenna := range candidates {
+			near, err := antennaNearLocations(antenna, index)
+			if err != nil {
+				return nil, err
+			}
+			if near {
+				antennas = append(antennas, antenna)
+			}
+		}
+	}
+	return antennas, nil
+}
+
+// locationIndex buckets locations in a grid of square cells, so that a search only checks the locations in the cells
+// around a point
+type locationIndex struct {
+	cellDegrees float64
+	cells       map[[2]int][]haversine.Coord
+}
+
+// newLocationIndex returns an index of the locations, for searches within up to about km. Smaller cells would make a
+// search go through more of them, larger ones through more locations.
+func newLocationIndex(locations []haversine.Coord, km float64) *locationIndex {
+	index := &locationIndex{cellDegrees: math.Max(km/kmPerDegreeLatitude/4, 0.01), cells: map[[2]int][]haversine.Coord{}}
+	for _, location := range locations {
+		cell := [2]int{index.cell(location.Lon), index.cell(location.Lat)}
+		index.cells[cell] = append(index.cells[cell], location)
+	}
+	return index
+}
+
+func (index *locationIndex) cell(degrees float64) int {
+	return int(math.Floor(degrees / index.cellDegrees))
+}
+
+// near reports whether any of the locations is within km of the point
+func (index *locationIndex) near(point haversine.Coord, km float64) bool {
+	minLatitude, maxLatitude, minLongitude, maxLongitude := boundingBox(point.Lat, point.Lon, km)
+	for x := index.cell(minLongitude); x <= index.cell(maxLongitude); x++ {
+		for y := index.cell(minLatitude); y <= index.cell(maxLatitude); y++ {
+			for _, location := range index.cells[[2]int{x, y}] {
+				if _, distance := haversine.Distance(point, location); distance <= km {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// antennaNearLocations reports whether any of the indexed locations is within the range of the antenna
+func antennaNearLocations(antenna types.Antenna, locations *locationIndex) (bool, error) {
+	gatewayIndexer := types.GatewayIndexer{NetworkId: antenna.NetworkId, GatewayId: antenna.GatewayId}
+	latitude, longitude, err := gatewayLocation(gatewayIndexer, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if latitude == 0 && longitude == 0 {
+		return false, nil
+	}
+	rangeKm, err := gatewayMaximumRangeKm(gatewayIndexer)
+	if err != nil {
+		return false, err
+	}
+
+	return locations.near(haversine.Coord{Lat: latitude, Lon: longitude}, rangeKm+deviceLocationSlackKm), nil
+}
+
+// mergeAntennas returns the antennas in either list once, ordered by ID
+func mergeAntennas(a []types.Antenna, b []types.Antenna) []types.Antenna {
+	seen := map[uint]bool{}
+	merged := make([]types.Antenna, 0, len(a)+len(b))
+	for _, antenna := range append(append([]types.Antenna{}, a...), b...) {
+		if !seen[antenna.ID] {
+			seen[antenna.ID] = true
+			merged = append(merged, antenna)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].ID < merged[j].ID })
+	return merged
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/umahmood/haversine"
+	"testing"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+func TestBlockedAt(t *testing.T) {
+	from := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	bounded := []types.BlockedDevice{{BlockedFrom: &from, BlockedUntil: &until}}
+
+	tests := []struct {
+		blocks []types.BlockedDevice
+		at     time.Time
+		want   bool
+	}{
+		{nil, from, false},
+		{[]types.BlockedDevice{{}}, from, true},
+		{bounded, from.Add(-time.Second), false},
+		{bounded, from, true},
+		{bounded, until.Add(-time.Second), true},
+		{bounded, until, false},
+		{[]types.BlockedDevice{{BlockedFrom: &from}}, until.AddDate(1, 0, 0), true},
+	}
+	for i, test := range tests {
+		if got := blockedAt(test.blocks, test.at); got != test.want {
+			t.Errorf("%d: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestAntennaNearLocations(t *testing.T) {
+	gatewayIndexer := types.GatewayIndexer{NetworkId: "thethingsnetwork.org", GatewayId: "eui-near"}
+	latitude, longitude := 52.0, 5.0
+	cacheGatewayLocations(t, gatewayIndexer, nil, nil, types.Gateway{ID: 1, Latitude: &latitude, Longitude: &longitude})
+	gatewayRangeDbCache.Set(gatewayIndexer, &types.GatewayRangeOverride{MaximumRangeKm: 10})
+	t.Cleanup(func() { gatewayRangeDbCache.Delete(gatewayIndexer) })
+
+	antenna := types.Antenna{NetworkId: gatewayIndexer.NetworkId, GatewayId: gatewayIndexer.GatewayId}
+	far := haversine.Coord{Lat: 53.0, Lon: 5.0}
+	near := haversine.Coord{Lat: 52.05, Lon: 5.0}
+
+	if ok, err := antennaNearLocations(antenna, newLocationIndex([]haversine.Coord{far}, 200)); err != nil || ok {
+		t.Fatalf("a location 111 km away is near, %v", err)
+	}
+	if ok, err := antennaNearLocations(antenna, newLocationIndex([]haversine.Coord{far, near}, 200)); err != nil || !ok {
+		t.Fatalf("a location 6 km away is not near, %v", err)
+	}
+}
+
+func TestMergeAntennas(t *testing.T) {
+	merged := mergeAntennas([]types.Antenna{{ID: 3}, {ID: 1}}, []types.Antenna{{ID: 2}, {ID: 3}})
+	if len(merged) != 3 || merged[0].ID != 1 || merged[1].ID != 2 || merged[2].ID != 3 {
+		t.Fatalf("got %+v", merged)
+	}
+}
+
+func TestLocationIndexNear(t *testing.T) {
+	locations := []haversine.Coord{{Lat: 52.0, Lon: 5.0}, {Lat: -33.9, Lon: 151.2}, {Lat: 0.05, Lon: -179.95}}
+	index := newLocationIndex(locations, 10)
+
+	tests := []struct {
+		point haversine.Coord
+		want  bool
+	}{
+		{haversine.Coord{Lat: 52.05, Lon: 5.05}, true},
+		{haversine.Coord{Lat: 52.2, Lon: 5.0}, false},
+		{haversine.Coord{Lat: -33.95, Lon: 151.25}, true},
+		{haversine.Coord{Lat: 0, Lon: 179.99}, true}, // across the antimeridian
+		{haversine.Coord{Lat: 0, Lon: 0}, false},
+	}
+	for _, test := range tests {
+		if got := index.near(test.point, 10); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.point, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// Signal metrics the buckets can count
+const (
+	signalMetricRssi       = "rssi"
+	signalMetricSignalRssi = "signal_rssi" // falls back to rssi for gateways that do not report it
+	signalMetricRssiSnr    = "rssi_snr"    // rssi, lowered by the snr when it is negative
+	signalMetricSnr        = "snr"
+)
+
+// The buckets used before they were configurable, which all cells created before then are counted with
+var legacyBucketEdges = []float64{-95, -100, -105, -110, -115, -120, -125, -130, -135, -140, -145}
+
+// ID of the bucket schema of the current configuration, set by loadBucketSchema
+var bucketSchemaID uint
+
+// validateBucketSchema checks that the configured edges fit the bucket columns
+func validateBucketSchema() error {
+	switch myConfiguration.SignalMetric {
+	case signalMetricRssi, signalMetricSignalRssi, signalMetricRssiSnr, signalMetricSnr:
+	default:
+		return errors.New("unknown signal metric " + myConfiguration.SignalMetric)
+	}
+
+	edges := myConfiguration.SignalBucketEdges
+	if len(edges) != len(legacyBucketEdges) {
+		return errors.New("need exactly " + strconv.Itoa(len(legacyBucketEdges)) + " signal bucket edges")
+	}
+	for i := 1; i < len(edges); i++ {
+		if edges[i] >= edges[i-1] {
+			return errors.New("signal bucket edges must be in descending order")
+		}
+	}
+	return nil
+}
+
+func bucketEdgesString(edges []float64) string {
+	values := make([]string, 0, len(edges))
+	for _, edge := range edges {
+		values = append(values, strconv.FormatFloat(edge, 'f', -1, 64))
+	}
+	return strings.Join(values, ",")
+}
+
+// loadBucketSchema finds or records the bucket schema of the current configuration
+func loadBucketSchema() error {
+	schema, err := findOrCreateBucketSchema(myConfiguration.SignalMetric, myConfiguration.SignalBucketEdges, myConfiguration.DecayHalfLifeDays, myConfiguration.SmearMode)
+	if err != nil {
+		return err
+	}
+	bucketSchemaID = schema.ID
+	return nil
+}
+
+// findOrCreateBucketSchema matches on every field, including the ones that are zero, which a struct condition ignores
+func findOrCreateBucketSchema(metric string, edges []float64, decayHalfLifeDays float64, smearMode string) (types.BucketSchema, error) {
+	schema := types.BucketSchema{Metric: metric, Edges: bucketEdgesString(edges), DecayHalfLifeDays: decayHalfLifeDays, SmearMode: smearMode}
+	err := db.Where("metric = ? AND edges = ? AND decay_half_life_days = ? AND smear_mode = ?", schema.Metric, schema.Edges, schema.DecayHalfLifeDays, schema.SmearMode).
+		FirstOrCreate(&schema).Error
+	return schema, err
+}
+
+// signalLevel calculates the configured signal metric
+func signalLevel(rssi float32, signalRssi *float32, snr float32) float32 {
+	switch myConfiguration.SignalMetric {
+	case signalMetricRssi:
+		return rssi
+	case signalMetricSignalRssi:
+		if signalRssi != nil {
+			return *signalRssi
+		}
+		return rssi
+	case signalMetricSnr:
+		return snr
+	default:
+		signal := rssi
+		if snr < 0 {
+			signal += snr
+		}
+		return signal
+	}
+}
+
+// gatewaySignalRssi returns the signal RSSI of a live gateway, or nil if it did not report one
+func gatewaySignalRssi(gateway types.TtnMapperGateway) *float32 {
+	if gateway.SignalRssi == 0 {
+		return nil
+	}
+	signalRssi := gateway.SignalRssi
+	return &signalRssi
+}
+
+// signalBands returns the bucket counters from the strongest to the weakest signal, one more than there are edges
+func signalBands(buckets *types.SignalBuckets) []*uint32 {
+	return []*uint32{
+		&buckets.BucketHigh,
+		&buckets.Bucket100,
+		&buckets.Bucket105,
+		&buckets.Bucket110,
+		&buckets.Bucket115,
+		&buckets.Bucket120,
+		&buckets.Bucket125,
+		&buckets.Bucket130,
+		&buckets.Bucket135,
+		&buckets.Bucket140,
+		&buckets.Bucket145,
+		&buckets.BucketLow,
+	}
+}
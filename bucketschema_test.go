@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+func TestIncrementBucket(t *testing.T) {
+	now := time.Now()
+
+	var buckets types.SignalBuckets
+	incrementBucket(&buckets, now, -90, nil, 5)
+	incrementBucket(&buckets, now, -95, nil, 5) // edges belong to the weaker band
+	incrementBucket(&buckets, now, -144.5, nil, 5)
+	incrementBucket(&buckets, now, -150, nil, 5)
+
+	if buckets.BucketHigh != 1 || buckets.Bucket100 != 1 || buckets.Bucket145 != 1 || buckets.BucketLow != 1 {
+		t.Fatalf("unexpected buckets %+v", buckets)
+	}
+	if !buckets.LastUpdated.Equal(now) {
+		t.Fatalf("last updated not set")
+	}
+
+	statistics := buckets.SignalStatistics
+	if statistics.SignalCount != 4 || *statistics.RssiMin != -150 || *statistics.RssiMax != -90 || statistics.SnrSum != 20 {
+		t.Fatalf("unexpected statistics %+v", statistics)
+	}
+
+	// Merging keeps the earliest first seen time, and sums the rest
+	earlier := types.SignalBuckets{}
+	incrementBucket(&earlier, now.Add(-time.Hour), -80, nil, -10)
+	addSignalBuckets(&buckets, earlier)
+	statistics = buckets.SignalStatistics
+	if statistics.SignalCount != 5 || *statistics.RssiMax != -80 || *statistics.SnrMin != -10 || !statistics.FirstSeen.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("unexpected merged statistics %+v", statistics)
+	}
+}
+
+func TestSignalLevel(t *testing.T) {
+	defer func(metric string) { myConfiguration.SignalMetric = metric }(myConfiguration.SignalMetric)
+
+	signalRssi := float32(-110)
+	tests := []struct {
+		metric     string
+		signalRssi *float32
+		want       float32
+	}{
+		{signalMetricRssiSnr, nil, -105},
+		{signalMetricRssi, nil, -100},
+		{signalMetricSignalRssi, &signalRssi, -110},
+		{signalMetricSignalRssi, nil, -100},
+		{signalMetricSnr, nil, -5},
+	}
+	for _, test := range tests {
+		myConfiguration.SignalMetric = test.metric
+		if got := signalLevel(-100, test.signalRssi, -5); got != test.want {
+			t.Errorf("%s: got %f, want %f", test.metric, got, test.want)
+		}
+	}
+
+	myConfiguration.SignalMetric = signalMetricRssiSnr
+	if got := signalLevel(-100, nil, 5); got != -100 {
+		t.Errorf("positive snr should not raise the signal, got %f", got)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// gridCellBuffer collects live grid cell increments and adds them to the database in bulk. Increments to the same
+// grid cell are summed, so a busy cell is written once per flush instead of once per packet.
+type gridCellBuffer struct {
+	mutex      sync.Mutex
+	flushMutex sync.Mutex
+	pending    *liveCells
+	callbacks  []func(error) // called with the result of the flush that contains the updates made before them
+	trigger    chan struct{}
+}
+
+var gridCellWriteBuffer = newGridCellBuffer()
+
+func newGridCellBuffer() *gridCellBuffer {
+	return &gridCellBuffer{
+		pending: newCellMaps(),
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+func gridCellBufferEnabled() bool {
+	return myConfiguration.GridCellBufferSize > 0
+}
+
+func validateGridCellBuffer() error {
+	if gridCellBufferEnabled() && myConfiguration.GridCellBufferFlushSeconds <= 0 {
+		return errors.New("the grid cell buffer flush interval must be positive")
+	}
+	return nil
+}
+
+// AddLive sums the cells of one live uplink into the buffered increments, and registers a callback that is called
+// once they have been written to the database, or have failed to be written. This is used to only ack a message once
+// its cells are stored. All cells of the uplink always end up in the same flush.
+func (b *gridCellBuffer) AddLive(cells *liveCells, callback func(error)) {
+	b.mutex.Lock()
+	b.pending.add(cells)
+	b.callbacks = append(b.callbacks, callback)
+	// Unacked messages are limited by the prefetch count, so waiting for more would stall the consumer
+	full := b.full() || len(b.callbacks) >= myConfiguration.AmqpPrefetchCount
+	b.mutex.Unlock()
+
+	if full {
+		b.requestFlush()
+	}
+}
+
+// full updates the depth metric and reports whether a flush is needed. It must be called with the mutex held.
+func (b *gridCellBuffer) full() bool {
+	depth := b.pending.size()
+	gridCellBufferDepth.Set(float64(depth))
+	return depth >= myConfiguration.GridCellBufferSize
+}
+
+func (b *gridCellBuffer) requestFlush() {
+	select {
+	case b.trigger <- struct{}{}:
+	default:
+		// A flush is already pending
+	}
+}
+
+// Run flushes the buffer when it is full, or when the flush interval passed
+func (b *gridCellBuffer) Run() {
+	ticker := time.NewTicker(time.Duration(myConfiguration.GridCellBufferFlushSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.trigger:
+		}
+		if err := b.Flush(); err != nil {
+			log.Println("Failed to flush grid cells:", err.Error())
+		}
+	}
+}
+
+// Flush adds all buffered increments to the database in one transaction and notifies the waiting callbacks. If that
+// fails with manual acks, the increments are dropped and the callbacks get the messages they came from redelivered.
+// Auto-acked messages are never redelivered, so then the increments and callbacks are kept for the next flush.
+func (b *gridCellBuffer) Flush() error {
+	b.flushMutex.Lock()
+	defer b.flushMutex.Unlock()
+
+	b.mutex.Lock()
+	pending := b.pending
+	callbacks := b.callbacks
+	b.pending = newCellMaps()
+	b.callbacks = nil
+	gridCellBufferDepth.Set(0)
+	b.mutex.Unlock()
+
+	if pending.size() == 0 && len(callbacks) == 0 {
+		return nil
+	}
+
+	flushStart := time.Now()
+	var err error
+	if pending.size() > 0 {
+		// All kinds of cells contain the same messages, so they are stored together
+		err = db.Transaction(pending.Increment)
+	}
+	flushElapsed := time.Since(flushStart)
+	gridCellBufferFlushDuration.Observe(float64(flushElapsed.Nanoseconds()) / 1000.0 / 1000.0) //nanoseconds to milliseconds
+
+	if err != nil && !myConfiguration.AmqpManualAck {
+		b.mutex.Lock()
+		b.pending.add(pending)
+		b.callbacks = append(callbacks, b.callbacks...)
+		b.full()
+		b.mutex.Unlock()
+		return err
+	}
+
+	for _, callback := range callbacks {
+		callback(err)
+	}
+
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"testing"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// useUnreachableDb points db at a database that refuses connections, so that every query fails, until the test ends
+func useUnreachableDb(t *testing.T) {
+	unreachable, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"), &gorm.Config{
+		Logger:               logger.Default.LogMode(logger.Silent),
+		DisableAutomaticPing: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = unreachable
+	t.Cleanup(func() { db = previous })
+}
+
+func testGridCell(t *testing.T) types.GridCell {
+	gridCell, err := getGridCell(1, 52.0, 5.0, 19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	incrementBucket(&gridCell.SignalBuckets, time.Now(), -90, nil, 5)
+	return gridCell
+}
+
+// testLiveCells returns the increments of an uplink heard at a single grid cell
+func testLiveCells(t *testing.T) *liveCells {
+	cells := newLiveCells()
+	cells.gridCells.add(testGridCell(t))
+	return cells
+}
+
+func TestGridCellBufferCoalesces(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	myConfiguration.GridCellBufferSize = 10
+	myConfiguration.AmqpPrefetchCount = 10
+
+	b := newGridCellBuffer()
+	b.AddLive(testLiveCells(t), func(err error) {})
+	b.AddLive(testLiveCells(t), func(err error) {})
+
+	if len(b.pending.gridCells) != 1 {
+		t.Fatalf("got %d buffered cells, want 1", len(b.pending.gridCells))
+	}
+	for _, gridCell := range b.pending.gridCells {
+		if gridCell.BucketHigh != 2 {
+			t.Fatalf("got %d packets, want 2", gridCell.BucketHigh)
+		}
+	}
+	if len(b.callbacks) != 2 {
+		t.Fatalf("got %d callbacks, want 2", len(b.callbacks))
+	}
+}
+
+func TestGridCellBufferCallbacks(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	myConfiguration.GridCellBufferSize = 10
+	myConfiguration.AmqpPrefetchCount = 10
+
+	b := newGridCellBuffer()
+	var order []int
+	b.AddLive(newLiveCells(), func(err error) { order = append(order, 1) })
+	b.AddLive(newLiveCells(), func(err error) { order = append(order, 2) })
+
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Fatalf("callbacks called in order %v", order)
+	}
+	if len(b.callbacks) != 0 {
+		t.Fatal("callbacks not removed after the flush")
+	}
+}
+
+func TestGridCellBufferFailedFlush(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	useUnreachableDb(t)
+	myConfiguration.GridCellBufferSize = 10
+	myConfiguration.AmqpPrefetchCount = 10
+
+	// Auto-acked messages are not redelivered, so their increments are kept
+	myConfiguration.AmqpManualAck = false
+	b := newGridCellBuffer()
+	called := false
+	b.AddLive(testLiveCells(t), func(err error) { called = true })
+	if err := b.Flush(); err == nil {
+		t.Fatal("flush to an unreachable database succeeded")
+	}
+	if called || len(b.pending.gridCells) != 1 || len(b.callbacks) != 1 {
+		t.Fatalf("increments not kept, called %v, %d cells and %d callbacks", called, len(b.pending.gridCells), len(b.callbacks))
+	}
+
+	// With manual acks the messages are redelivered instead
+	myConfiguration.AmqpManualAck = true
+	var result error
+	b.AddLive(newLiveCells(), func(err error) { result = err })
+	if err := b.Flush(); err == nil || result != err {
+		t.Fatalf("callback got %v, want the flush error %v", result, err)
+	}
+	if len(b.pending.gridCells) != 0 || len(b.callbacks) != 0 {
+		t.Fatal("increments kept although they are redelivered")
+	}
+}
+
+func TestValidateGridCellBuffer(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	myConfiguration.GridCellBufferSize = 10
+	myConfiguration.GridCellBufferFlushSeconds = 0
+	if validateGridCellBuffer() == nil {
+		t.Fatal("accepted a flush interval of 0")
+	}
+	myConfiguration.GridCellBufferSize = 0
+	if err := validateGridCellBuffer(); err != nil {
+		t.Fatalf("disabled buffer rejected: %v", err)
+	}
+}
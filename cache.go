@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// lruCache is a size bounded cache that evicts the least recently used entry when full, and treats entries older
+// than the time to live as missing. It is safe for concurrent use.
+type lruCache struct {
+	name       string
+	entryBytes int // rough memory use of one entry, used to size the cache from the memory budget
+
+	mutex      sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[interface{}]*list.Element
+	order      *list.List // most recently used at the front
+}
+
+type lruEntry struct {
+	key     interface{}
+	value   interface{}
+	expires time.Time
+}
+
+// All caches, so that they can share the memory budget
+var lruCaches []*lruCache
+
+func newLruCache(name string, entryBytes int, ttl time.Duration) *lruCache {
+	c := &lruCache{
+		name:       name,
+		entryBytes: entryBytes,
+		ttl:        ttl,
+		entries:    map[interface{}]*list.Element{},
+		order:      list.New(),
+	}
+	lruCaches = append(lruCaches, c)
+	c.resize()
+	return c
+}
+
+// resize sets the maximum number of entries to an equal share of the memory budget
+func (c *lruCache) resize() {
+	budget := myConfiguration.CacheMemoryBudgetMb * 1024 * 1024 / len(lruCaches)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.maxEntries = budget / c.entryBytes
+	if c.maxEntries < 1 {
+		c.maxEntries = 1
+	}
+	for c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+		cacheEvictions.WithLabelValues(c.name, "size").Inc()
+	}
+}
+
+func (c *lruCache) setTtl(ttl time.Duration) {
+	c.mutex.Lock()
+	c.ttl = ttl
+	c.mutex.Unlock()
+}
+
+func (c *lruCache) Get(key interface{}) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		cacheMisses.WithLabelValues(c.name).Inc()
+		return nil, false
+	}
+
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.removeElement(element)
+		cacheEvictions.WithLabelValues(c.name, "expired").Inc()
+		cacheMisses.WithLabelValues(c.name).Inc()
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	cacheHits.WithLabelValues(c.name).Inc()
+	return entry.value, true
+}
+
+func (c *lruCache) Set(key interface{}, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+		cacheEvictions.WithLabelValues(c.name, "size").Inc()
+	}
+	cacheEntries.WithLabelValues(c.name).Set(float64(c.order.Len()))
+}
+
+func (c *lruCache) Delete(key interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+// removeElement must be called with the mutex held
+func (c *lruCache) removeElement(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*lruEntry).key)
+	cacheEntries.WithLabelValues(c.name).Set(float64(c.order.Len()))
+}
+
+// Typed wrappers around lruCache for each kind of lookup
+
+type antennaCache struct {
+	*lruCache
+}
+
+func (c antennaCache) Get(antennaIndexer types.AntennaIndexer) (uint, bool) {
+	i, ok := c.lruCache.Get(antennaIndexer)
+	if !ok {
+		return 0, false
+	}
+	return i.(uint), true
+}
+
+func (c antennaCache) Set(antennaIndexer types.AntennaIndexer, antennaID uint) {
+	c.lruCache.Set(antennaIndexer, antennaID)
+}
+
+type gatewayCache struct {
+	*lruCache
+}
+
+func (c gatewayCache) Get(gatewayIndexer types.GatewayIndexer) (types.Gateway, bool) {
+	i, ok := c.lruCache.Get(gatewayIndexer)
+	if !ok {
+		return types.Gateway{}, false
+	}
+	return i.(types.Gateway), true
+}
+
+func (c gatewayCache) Set(gatewayIndexer types.GatewayIndexer, gateway types.Gateway) {
+	c.lruCache.Set(gatewayIndexer, gateway)
+}
+
+func (c gatewayCache) Delete(gatewayIndexer types.GatewayIndexer) {
+	c.lruCache.Delete(gatewayIndexer)
+}
+
+// gatewayRangeCache also remembers gateways without a range override, as a nil value
+type gatewayRangeCache struct {
+	*lruCache
+}
+
+func (c gatewayRangeCache) Get(gatewayIndexer types.GatewayIndexer) (*types.GatewayRangeOverride, bool) {
+	i, ok := c.lruCache.Get(gatewayIndexer)
+	if !ok {
+		return nil, false
+	}
+	return i.(*types.GatewayRangeOverride), true
+}
+
+func (c gatewayRangeCache) Set(gatewayIndexer types.GatewayIndexer, override *types.GatewayRangeOverride) {
+	c.lruCache.Set(gatewayIndexer, override)
+}
+
+// networksRangeCache holds the largest range override of a set of networks, keyed by their sorted IDs. Networks
+// without any override are remembered as a nil value.
+type networksRangeCache struct {
+	*lruCache
+}
+
+func (c networksRangeCache) Get(networkIds string) (*float64, bool) {
+	i, ok := c.lruCache.Get(networkIds)
+	if !ok {
+		return nil, false
+	}
+	return i.(*float64), true
+}
+
+func (c networksRangeCache) Set(networkIds string, overrideRangeKm *float64) {
+	c.lruCache.Set(networkIds, overrideRangeKm)
+}
+
+// gatewayForceCache also remembers gateways without a forced location, as a nil value
+type gatewayForceCache struct {
+	*lruCache
+}
+
+func (c gatewayForceCache) Get(gatewayIndexer types.GatewayIndexer) (*types.GatewayLocationForce, bool) {
+	i, ok := c.lruCache.Get(gatewayIndexer)
+	if !ok {
+		return nil, false
+	}
+	return i.(*types.GatewayLocationForce), true
+}
+
+func (c gatewayForceCache) Set(gatewayIndexer types.GatewayIndexer, force *types.GatewayLocationForce) {
+	c.lruCache.Set(gatewayIndexer, force)
+}
+
+func (c gatewayForceCache) Delete(gatewayIndexer types.GatewayIndexer) {
+	c.lruCache.Delete(gatewayIndexer)
+}
+
+type gatewayLocationsCache struct {
+	*lruCache
+}
+
+func (c gatewayLocationsCache) Get(gatewayIndexer types.GatewayIndexer) ([]types.GatewayLocation, bool) {
+	i, ok := c.lruCache.Get(gatewayIndexer)
+	if !ok {
+		return nil, false
+	}
+	return i.([]types.GatewayLocation), true
+}
+
+func (c gatewayLocationsCache) Set(gatewayIndexer types.GatewayIndexer, locations []types.GatewayLocation) {
+	c.lruCache.Set(gatewayIndexer, locations)
+}
+
+func (c gatewayLocationsCache) Delete(gatewayIndexer types.GatewayIndexer) {
+	c.lruCache.Delete(gatewayIndexer)
+}
+
+// configureCaches applies the configured memory budget and time to live to all caches, after the configuration
+// has been loaded.
+func configureCaches() {
+	antennaDbCache.setTtl(time.Duration(myConfiguration.AntennaCacheTtlSeconds) * time.Second)
+	gatewayDbCache.setTtl(time.Duration(myConfiguration.GatewayCacheTtlSeconds) * time.Second)
+	gatewayForceDbCache.setTtl(time.Duration(myConfiguration.GatewayCacheTtlSeconds) * time.Second)
+	gatewayLocationsDbCache.setTtl(time.Duration(myConfiguration.GatewayCacheTtlSeconds) * time.Second)
+	blockedDeviceDbCache.setTtl(time.Duration(myConfiguration.DeviceCacheTtlSeconds) * time.Second)
+	gatewayRangeDbCache.setTtl(time.Duration(myConfiguration.GatewayCacheTtlSeconds) * time.Second)
+	networksRangeDbCache.setTtl(time.Duration(myConfiguration.GatewayCacheTtlSeconds) * time.Second)
+
+	for _, c := range lruCaches {
+		c.resize()
+	}
+}
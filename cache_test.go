@@ -0,0 +1,38 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+	"time"
+)
+
+func TestLruCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := &lruCache{name: "test", maxEntries: 2, ttl: time.Hour, entries: map[interface{}]*list.Element{}, order: list.New()}
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a") // b is now least recently used
+	c.Set("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b should have been evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v.(int) != 1 {
+		t.Fatal("a should still be cached")
+	}
+	if v, ok := c.Get("c"); !ok || v.(int) != 3 {
+		t.Fatal("c should be cached")
+	}
+}
+
+func TestLruCacheExpires(t *testing.T) {
+	c := &lruCache{name: "test", maxEntries: 10, ttl: -time.Second, entries: map[interface{}]*list.Element{}, order: list.New()}
+
+	c.Set("a", 1)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expired entry returned")
+	}
+	if len(c.entries) != 0 || c.order.Len() != 0 {
+		t.Fatal("expired entry not removed")
+	}
+}
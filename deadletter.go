@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+	"time"
+)
+
+// Stages at which a delivery can fail, recorded in the dead letter headers
+const (
+	failureStageDecode    = "decode"
+	failureStageAggregate = "aggregate"
+)
+
+// Headers added to dead lettered messages
+const (
+	headerFailureStage       = "x-failure-stage"
+	headerFailureError       = "x-failure-error"
+	headerFailureTime        = "x-failure-time"
+	headerOriginalExchange   = "x-original-exchange"
+	headerOriginalRoutingKey = "x-original-routing-key"
+	headerOriginalQueue      = "x-original-queue"
+
+	// Number of times processing the message failed, set when it is published again for a retry
+	headerAttempts = "x-attempts"
+)
+
+var (
+	deadLetterMutex      sync.Mutex
+	deadLetterConnection *amqp.Connection
+	deadLetterChannel    *amqp.Channel
+	deadLetterConfirms   chan amqp.Confirmation
+)
+
+func deadLetterEnabled() bool {
+	return myConfiguration.AmqpExchangeDeadLetter != ""
+}
+
+func validateDeadLetter() error {
+	if deadLetterEnabled() && myConfiguration.AmqpMaxAttempts < 1 {
+		return errors.New("at least one attempt is needed before dead lettering a message")
+	}
+	return nil
+}
+
+// settleDelivery decides what happens to a delivery after processing. Successful deliveries are acked. Messages that
+// can not be decoded are moved to the dead letter exchange, or dropped without one. Failed messages are retried:
+// without a dead letter exchange they are requeued until they succeed, as they would be lost otherwise. With one they
+// are published to their queue again with an attempt count, and moved to the dead letter exchange after
+// AmqpMaxAttempts. The original is only acked once the broker confirmed the new copy.
+func settleDelivery(d amqp.Delivery, stage string, err error) {
+	if err == nil {
+		ackDelivery(d, nil, false)
+		return
+	}
+
+	// Work interrupted by a shutdown is not the message's fault, so always retry it
+	if err == errShuttingDown {
+		ackDelivery(d, err, true)
+		return
+	}
+
+	if !deadLetterEnabled() {
+		ackDelivery(d, err, stage == failureStageAggregate)
+		return
+	}
+
+	attempts := deliveryAttempts(d) + 1
+	if stage == failureStageAggregate && attempts < myConfiguration.AmqpMaxAttempts {
+		headers := copyHeaders(d.Headers)
+		headers[headerAttempts] = int32(attempts)
+		if rErr := publishConfirmed("", deliveryQueue(d), d, headers); rErr != nil {
+			log.Println("Failed to retry message:", rErr.Error())
+			ackDelivery(d, err, true)
+			return
+		}
+		ackDelivery(d, nil, false)
+		return
+	}
+
+	headers := copyHeaders(d.Headers)
+	headers[headerFailureStage] = stage
+	headers[headerFailureError] = err.Error()
+	headers[headerFailureTime] = time.Now().UTC().Format(time.RFC3339)
+	headers[headerOriginalExchange] = d.Exchange
+	headers[headerOriginalRoutingKey] = d.RoutingKey
+	headers[headerOriginalQueue] = deliveryQueue(d)
+	if dlErr := publishConfirmed(myConfiguration.AmqpExchangeDeadLetter, "", d, headers); dlErr != nil {
+		// The dead letter exchange is unavailable, so rather keep the message where it is
+		log.Println("Failed to dead letter message:", dlErr.Error())
+		ackDelivery(d, err, true)
+		return
+	}
+	deadLetteredMessages.WithLabelValues(stage).Inc()
+
+	// The message now lives on the dead letter queue, so it can be removed from the original queue
+	ackDelivery(d, nil, false)
+}
+
+// deliveryAttempts returns how often processing the delivery failed before
+func deliveryAttempts(d amqp.Delivery) int {
+	switch attempts := d.Headers[headerAttempts].(type) {
+	case int32:
+		return int(attempts)
+	case int64:
+		return int(attempts)
+	case int:
+		return attempts
+	default:
+		return 0
+	}
+}
+
+// deliveryQueue returns the queue a delivery was consumed from. Retried and replayed messages are published to it
+// directly through the default exchange, with the queue as routing key.
+func deliveryQueue(d amqp.Delivery) string {
+	if d.Exchange == "" {
+		return d.RoutingKey
+	}
+	return exchangeQueue(d.Exchange)
+}
+
+func copyHeaders(headers amqp.Table) amqp.Table {
+	copied := amqp.Table{}
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
+
+// publishConfirmed publishes the body of a delivery with the given headers, and waits until the broker confirms it
+func publishConfirmed(exchange string, routingKey string, d amqp.Delivery, headers amqp.Table) error {
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+
+	if deadLetterChannel == nil {
+		conn, ch, confirms, err := connectDeadLetter()
+		if err != nil {
+			return err
+		}
+		deadLetterConnection = conn
+		deadLetterChannel = ch
+		deadLetterConfirms = confirms
+	}
+
+	err := deadLetterChannel.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		amqp.Publishing{
+			Headers:         headers,
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			DeliveryMode:    amqp.Persistent,
+			Timestamp:       d.Timestamp,
+			Body:            d.Body,
+		})
+	if err == nil {
+		if confirm, ok := <-deadLetterConfirms; !ok || !confirm.Ack {
+			err = errors.New("broker did not confirm the message")
+		}
+	}
+	if err != nil {
+		// Drop the connection so that we reconnect on the next attempt
+		deadLetterConnection.Close()
+		deadLetterConnection = nil
+		deadLetterChannel = nil
+		deadLetterConfirms = nil
+	}
+	return err
+}
+
+func closeDeadLetter() {
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+
+	if deadLetterConnection != nil {
+		deadLetterConnection.Close()
+		deadLetterConnection = nil
+		deadLetterChannel = nil
+	}
+}
+
+// connectDeadLetter opens a connection to the broker and declares the dead letter exchange and its queue. The channel
+// is in confirm mode, and the confirmations of its publishings are sent to confirms.
+func connectDeadLetter() (conn *amqp.Connection, ch *amqp.Channel, confirms chan amqp.Confirmation, err error) {
+	conn, err = amqp.Dial(amqpUrl())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ch, err = conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	err = declareDeadLetter(ch)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	return conn, ch, confirms, nil
+}
+
+func declareDeadLetter(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(
+		myConfiguration.AmqpExchangeDeadLetter, // name
+		"fanout",                               // type
+		true,                                   // durable
+		false,                                  // auto-deleted
+		false,                                  // internal
+		false,                                  // no-wait
+		nil,                                    // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	q, err := ch.QueueDeclare(
+		myConfiguration.AmqpQueueDeadLetter, // name
+		true,                                // durable
+		false,                               // delete when unused
+		false,                               // exclusive
+		false,                               // no-wait
+		nil,                                 // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	return ch.QueueBind(
+		q.Name,                                 // queue name
+		"",                                     // routing key
+		myConfiguration.AmqpExchangeDeadLetter, // exchange
+		false,
+		nil)
+}
+
+// exchangeQueue returns the queue this service consumes the exchange with
+func exchangeQueue(exchange string) string {
+	switch exchange {
+	case myConfiguration.AmqpExchangeInsertedData:
+		return myConfiguration.AmqpQueueInsertedData
+	case myConfiguration.AmqpExchangeGatewayMoved:
+		return myConfiguration.AmqpQueueGatewayMoved
+	default:
+		return ""
+	}
+}
+
+// replayQueue returns the queue a dead lettered message was consumed from. Messages dead lettered before the queue
+// was recorded fall back to the queue of their original exchange.
+func replayQueue(headers amqp.Table) string {
+	if queue, _ := headers[headerOriginalQueue].(string); queue != "" {
+		return queue
+	}
+	exchange, _ := headers[headerOriginalExchange].(string)
+	if exchange == "" {
+		return ""
+	}
+	return exchangeQueue(exchange)
+}
+
+// ReplayDeadLetterQueue publishes every message on the dead letter queue back to the queue it originally came from,
+// so that it goes through the pipeline again. It is published through the default exchange, as the original exchange
+// would also deliver it again to every other service bound to it. Only the messages present when the replay starts
+// are handled, so messages that fail again and end up back on the dead letter queue are not replayed in a loop.
+func ReplayDeadLetterQueue() error {
+	if !deadLetterEnabled() {
+		return errors.New("no dead letter exchange configured")
+	}
+
+	// The broker confirms every republished message before it is removed from the dead letter queue
+	conn, ch, confirms, err := connectDeadLetter()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	q, err := ch.QueueInspect(myConfiguration.AmqpQueueDeadLetter)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replaying %d dead lettered messages", q.Messages)
+
+	replayed := 0
+	for i := 0; i < q.Messages; i++ {
+		d, ok, err := ch.Get(q.Name, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		queue := replayQueue(d.Headers)
+		if queue == "" {
+			log.Println("Dead lettered message has no original queue, leaving it on the queue")
+			continue
+		}
+
+		headers := copyHeaders(d.Headers)
+		delete(headers, headerAttempts)
+		delete(headers, headerFailureStage)
+		delete(headers, headerFailureError)
+		delete(headers, headerFailureTime)
+		delete(headers, headerOriginalExchange)
+		delete(headers, headerOriginalRoutingKey)
+		delete(headers, headerOriginalQueue)
+
+		// The default exchange routes to the queue with the same name as the routing key
+		err = ch.Publish("", queue, false, false, amqp.Publishing{
+			Headers:         headers,
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			DeliveryMode:    amqp.Persistent,
+			Timestamp:       d.Timestamp,
+			Body:            d.Body,
+		})
+		if err != nil {
+			return err
+		}
+
+		if confirm, ok := <-confirms; !ok || !confirm.Ack {
+			return errors.New("broker did not confirm replayed message")
+		}
+
+		err = d.Ack(false)
+		if err != nil {
+			return err
+		}
+		replayed++
+	}
+
+	log.Printf("Replayed %d messages", replayed)
+	return nil
+}
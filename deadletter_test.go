@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+func TestSettleDelivery(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	myConfiguration.AmqpManualAck = true
+	myConfiguration.AmqpExchangeDeadLetter = ""
+	myConfiguration.AmqpMaxAttempts = 2
+	failed := errors.New("failed")
+
+	// Without a dead letter exchange failed uplinks are kept however often they fail
+	tests := []struct {
+		name     string
+		stage    string
+		err      error
+		attempts interface{}
+		acks     int
+		nacks    int
+		requeued bool
+	}{
+		{"success", failureStageAggregate, nil, nil, 1, 0, false},
+		{"shutdown", failureStageAggregate, errShuttingDown, nil, 0, 1, true},
+		{"first failure", failureStageAggregate, failed, nil, 0, 1, true},
+		{"later failure", failureStageAggregate, failed, int32(5), 0, 1, true},
+		{"invalid message", failureStageDecode, failed, nil, 0, 1, false},
+	}
+	for _, test := range tests {
+		acknowledger := &testAcknowledger{}
+		d := amqp.Delivery{Acknowledger: acknowledger, Redelivered: true, Headers: amqp.Table{}}
+		if test.attempts != nil {
+			d.Headers[headerAttempts] = test.attempts
+		}
+		settleDelivery(d, test.stage, test.err)
+		if acknowledger.acks != test.acks || acknowledger.nacks != test.nacks || acknowledger.requeued != test.requeued {
+			t.Errorf("%s: got %+v", test.name, acknowledger)
+		}
+	}
+
+	// Keep the message when it can not be retried or dead lettered
+	myConfiguration.AmqpExchangeDeadLetter = "dead_letter"
+	myConfiguration.AmqpHost = "127.0.0.1"
+	myConfiguration.AmqpPort = "1"
+	for _, attempts := range []int32{0, 1} {
+		acknowledger := &testAcknowledger{}
+		d := amqp.Delivery{Acknowledger: acknowledger, Headers: amqp.Table{headerAttempts: attempts}}
+		settleDelivery(d, failureStageAggregate, failed)
+		if acknowledger.acks != 0 || acknowledger.nacks != 1 || !acknowledger.requeued {
+			t.Errorf("%d attempts: got %+v", attempts, acknowledger)
+		}
+	}
+}
+
+func TestDeliveryAttempts(t *testing.T) {
+	tests := []struct {
+		attempts interface{}
+		want     int
+	}{
+		{nil, 0},
+		{int32(1), 1},
+		{int64(2), 2},
+		{"3", 0},
+	}
+	for _, test := range tests {
+		d := amqp.Delivery{Headers: amqp.Table{}}
+		if test.attempts != nil {
+			d.Headers[headerAttempts] = test.attempts
+		}
+		if got := deliveryAttempts(d); got != test.want {
+			t.Errorf("%v: got %d, want %d", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestDeliveryQueue(t *testing.T) {
+	if got := deliveryQueue(amqp.Delivery{Exchange: myConfiguration.AmqpExchangeInsertedData}); got != myConfiguration.AmqpQueueInsertedData {
+		t.Errorf("consumed from the exchange: got %q", got)
+	}
+	if got := deliveryQueue(amqp.Delivery{RoutingKey: "queue"}); got != "queue" {
+		t.Errorf("retried through the default exchange: got %q", got)
+	}
+}
+
+func TestReplayQueue(t *testing.T) {
+	tests := []struct {
+		headers amqp.Table
+		want    string
+	}{
+		{amqp.Table{headerOriginalQueue: "queue", headerOriginalExchange: myConfiguration.AmqpExchangeInsertedData}, "queue"},
+		{amqp.Table{headerOriginalExchange: myConfiguration.AmqpExchangeInsertedData}, myConfiguration.AmqpQueueInsertedData},
+		{amqp.Table{headerOriginalExchange: myConfiguration.AmqpExchangeGatewayMoved}, myConfiguration.AmqpQueueGatewayMoved},
+		{amqp.Table{headerOriginalExchange: "unknown"}, ""},
+		{amqp.Table{}, ""},
+	}
+	for i, test := range tests {
+		if got := replayQueue(test.headers); got != test.want {
+			t.Errorf("%d: got %q, want %q", i, got, test.want)
+		}
+	}
+}
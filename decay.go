@@ -0,0 +1,122 @@
+package main
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math"
+	"strconv"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// Decayed weights are stored as valued at the LastUpdated time of their cell. Merging two weights first decays the
+// older one to the time of the newer one, and readers decay the stored weights to the current time. Without decay
+// the weights are the fractional counts of smeared points.
+
+// Columns of the decayed weights, in the same order as signalWeights
+var signalWeightColumns = []string{
+	"weight_high",
+	"weight100",
+	"weight105",
+	"weight110",
+	"weight115",
+	"weight120",
+	"weight125",
+	"weight130",
+	"weight135",
+	"weight140",
+	"weight145",
+	"weight_low",
+	"weight_no_signal",
+}
+
+func decayEnabled() bool {
+	return myConfiguration.DecayHalfLifeDays > 0
+}
+
+// weightsEnabled is whether the weight columns are maintained
+func weightsEnabled() bool {
+	return decayEnabled() || myConfiguration.SmearMode == smearModeFraction
+}
+
+func decayHalfLifeSeconds() float64 {
+	return myConfiguration.DecayHalfLifeDays * 24 * 60 * 60
+}
+
+// decayFactor returns what a weight valued at from is worth at the later time to
+func decayFactor(from time.Time, to time.Time) float64 {
+	if !decayEnabled() || !to.After(from) {
+		return 1
+	}
+	return math.Pow(0.5, to.Sub(from).Seconds()/decayHalfLifeSeconds())
+}
+
+// signalWeights returns the weights of the signal bands from the strongest to the weakest signal, followed by the
+// weight of no signal
+func signalWeights(buckets *types.SignalBuckets) []*float64 {
+	return []*float64{
+		&buckets.WeightHigh,
+		&buckets.Weight100,
+		&buckets.Weight105,
+		&buckets.Weight110,
+		&buckets.Weight115,
+		&buckets.Weight120,
+		&buckets.Weight125,
+		&buckets.Weight130,
+		&buckets.Weight135,
+		&buckets.Weight140,
+		&buckets.Weight145,
+		&buckets.WeightLow,
+		&buckets.WeightNoSignal,
+	}
+}
+
+// addSignalWeights merges the weights of delta into buckets. It must be called before LastUpdated of buckets is
+// moved forward.
+func addSignalWeights(buckets *types.SignalBuckets, delta types.SignalBuckets) {
+	if !weightsEnabled() {
+		return
+	}
+
+	latest := buckets.LastUpdated
+	if delta.LastUpdated.After(latest) {
+		latest = delta.LastUpdated
+	}
+	bucketsFactor := decayFactor(buckets.LastUpdated, latest)
+	deltaFactor := decayFactor(delta.LastUpdated, latest)
+
+	weights := signalWeights(buckets)
+	deltaWeights := signalWeights(&delta)
+	for i := range weights {
+		*weights[i] = *weights[i]*bucketsFactor + *deltaWeights[i]*deltaFactor
+	}
+}
+
+// addDecayedWeight adds a packet at the given time to the weight with the given index in signalWeights. It must be
+// called before LastUpdated of buckets is moved forward.
+func addDecayedWeight(buckets *types.SignalBuckets, index int, at time.Time) {
+	delta := types.SignalBuckets{LastUpdated: at}
+	*signalWeights(&delta)[index] = 1
+	addSignalWeights(buckets, delta)
+}
+
+// decayAssignments returns the upsert assignments that merge the decayed weights of the new row into the existing row
+// in table, the SQL equivalent of addSignalWeights. Postgres evaluates all of them against the existing row, so they
+// see the last_updated from before the update.
+func decayAssignments(table string) clause.Set {
+	existingFactor, newFactor := "1", "1"
+	if decayEnabled() {
+		halfLife := strconv.FormatFloat(decayHalfLifeSeconds(), 'f', -1, 64)
+		existingFactor = "power(0.5, GREATEST(extract(epoch from (excluded.last_updated - " + table + ".last_updated)), 0) / " + halfLife + ")"
+		newFactor = "power(0.5, GREATEST(extract(epoch from (" + table + ".last_updated - excluded.last_updated)), 0) / " + halfLife + ")"
+	}
+
+	var assignments clause.Set
+	for _, column := range signalWeightColumns {
+		assignments = append(assignments, clause.Assignment{
+			Column: clause.Column{Name: column},
+			Value:  gorm.Expr(table + "." + column + " * " + existingFactor + " + excluded." + column + " * " + newFactor),
+		})
+	}
+	return assignments
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+func TestDecayedWeights(t *testing.T) {
+	defer func(days float64) { myConfiguration.DecayHalfLifeDays = days }(myConfiguration.DecayHalfLifeDays)
+	myConfiguration.DecayHalfLifeDays = 1
+
+	now := time.Now()
+	dayAgo := now.Add(-24 * time.Hour)
+
+	var buckets types.SignalBuckets
+	incrementBucket(&buckets, dayAgo, -90, nil, 5)
+	incrementBucket(&buckets, now, -90, nil, 5)
+	if math.Abs(buckets.WeightHigh-1.5) > 1e-9 {
+		t.Fatalf("got weight %f, want 1.5", buckets.WeightHigh)
+	}
+
+	// An older packet added later decays the same
+	var reordered types.SignalBuckets
+	incrementBucket(&reordered, now, -90, nil, 5)
+	incrementBucket(&reordered, dayAgo, -90, nil, 5)
+	if math.Abs(reordered.WeightHigh-buckets.WeightHigh) > 1e-9 || !reordered.LastUpdated.Equal(now) {
+		t.Fatalf("got weight %f at %v, want 1.5 at %v", reordered.WeightHigh, reordered.LastUpdated, now)
+	}
+
+	// Merging is the same as adding the packets one by one
+	var older types.SignalBuckets
+	incrementNoSignal(&older, dayAgo.Add(-24*time.Hour))
+	addSignalBuckets(&buckets, older)
+	if math.Abs(buckets.WeightNoSignal-0.25) > 1e-9 || buckets.WeightHigh != 1.5 {
+		t.Fatalf("unexpected merged weights %+v", buckets.SignalWeights)
+	}
+}
+
+func TestDecayDisabled(t *testing.T) {
+	defer func(days float64) { myConfiguration.DecayHalfLifeDays = days }(myConfiguration.DecayHalfLifeDays)
+	myConfiguration.DecayHalfLifeDays = 0
+
+	var buckets types.SignalBuckets
+	incrementBucket(&buckets, time.Now(), -90, nil, 5)
+	if buckets.WeightHigh != 0 {
+		t.Fatalf("weights kept while decay is disabled")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// FrequencyBand groups uplink frequencies, in Hz and inclusive, under a name stored with the cells
+type FrequencyBand struct {
+	Name  string
+	MinHz uint64
+	MaxHz uint64
+}
+
+// cellDimension selects the packets a cell counts. The zero value counts all packets.
+type cellDimension struct {
+	DataRateID    uint
+	FrequencyBand string
+}
+
+var (
+	dataRateDbCache  = dataRateCache{newLruCache("data_rate", 150, 24*time.Hour)}
+	frequencyDbCache = frequencyCache{newLruCache("frequency", 100, 24*time.Hour)}
+)
+
+type dataRateCache struct {
+	*lruCache
+}
+
+func (c dataRateCache) Get(dataRateIndexer types.DataRateIndexer) (uint, bool) {
+	i, ok := c.lruCache.Get(dataRateIndexer)
+	if !ok {
+		return 0, false
+	}
+	return i.(uint), true
+}
+
+func (c dataRateCache) Set(dataRateIndexer types.DataRateIndexer, dataRateID uint) {
+	c.lruCache.Set(dataRateIndexer, dataRateID)
+}
+
+type frequencyCache struct {
+	*lruCache
+}
+
+func (c frequencyCache) Get(frequencyID uint) (uint64, bool) {
+	i, ok := c.lruCache.Get(frequencyID)
+	if !ok {
+		return 0, false
+	}
+	return i.(uint64), true
+}
+
+func (c frequencyCache) Set(frequencyID uint, herz uint64) {
+	c.lruCache.Set(frequencyID, herz)
+}
+
+func dimensionsEnabled() bool {
+	return myConfiguration.AggregateByDataRate || len(myConfiguration.FrequencyBands) > 0
+}
+
+// validateFrequencyBands checks the configured bands. Large numbers in environment variables are parsed as floats
+// like "8.63e+08", which end up as 0, so a zero bound is rejected instead of silently matching nothing.
+func validateFrequencyBands() error {
+	names := map[string]bool{}
+	for _, band := range myConfiguration.FrequencyBands {
+		if band.Name == "" {
+			return errors.New("frequency band without a name")
+		}
+		if names[band.Name] {
+			return errors.New("frequency band " + band.Name + " is configured twice")
+		}
+		names[band.Name] = true
+		if band.MinHz == 0 || band.MaxHz == 0 {
+			return fmt.Errorf("frequency band %s has a zero bound, write them in Hz without an exponent", band.Name)
+		}
+		if band.MinHz > band.MaxHz {
+			return fmt.Errorf("frequency band %s starts above its end", band.Name)
+		}
+	}
+	return nil
+}
+
+// frequencyBand returns the name of the configured band containing the frequency, or "" if there is none
+func frequencyBand(herz uint64) string {
+	for _, band := range myConfiguration.FrequencyBands {
+		if herz >= band.MinHz && herz <= band.MaxHz {
+			return band.Name
+		}
+	}
+	return ""
+}
+
+// cellDimensions returns every dimension a packet is counted in: all packets, and each enabled combination of its
+// data rate and frequency band
+func cellDimensions(dataRateID uint, herz uint64) []cellDimension {
+	dataRates := []uint{0}
+	if myConfiguration.AggregateByDataRate && dataRateID != 0 {
+		dataRates = append(dataRates, dataRateID)
+	}
+	bands := []string{""}
+	if band := frequencyBand(herz); band != "" {
+		bands = append(bands, band)
+	}
+
+	dimensions := make([]cellDimension, 0, len(dataRates)*len(bands))
+	for _, dataRate := range dataRates {
+		for _, band := range bands {
+			dimensions = append(dimensions, cellDimension{DataRateID: dataRate, FrequencyBand: band})
+		}
+	}
+	return dimensions
+}
+
+func messageDimensions(message types.TtnMapperUplinkMessage) ([]cellDimension, error) {
+	if !dimensionsEnabled() {
+		return []cellDimension{{}}, nil
+	}
+
+	var dataRateID uint
+	if myConfiguration.AggregateByDataRate {
+		dataRateIndexer := types.DataRateIndexer{
+			Modulation:      message.Modulation,
+			Bandwidth:       message.Bandwidth,
+			SpreadingFactor: message.SpreadingFactor,
+			Bitrate:         message.Bitrate,
+		}
+		var err error
+		dataRateID, err = getDataRateID(dataRateIndexer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cellDimensions(dataRateID, message.Frequency), nil
+}
+
+func packetDimensions(packet types.Packet) ([]cellDimension, error) {
+	if !dimensionsEnabled() {
+		return []cellDimension{{}}, nil
+	}
+
+	var herz uint64
+	if len(myConfiguration.FrequencyBands) > 0 && packet.FrequencyID != 0 {
+		var err error
+		herz, err = getFrequencyHerz(packet.FrequencyID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cellDimensions(packet.DataRateID, herz), nil
+}
+
+// getDataRateID returns the ID of a data rate, creating the data rate if it is new
+func getDataRateID(dataRateIndexer types.DataRateIndexer) (uint, error) {
+	i, ok := dataRateDbCache.Get(dataRateIndexer)
+	if ok {
+		return i, nil
+	}
+
+	dataRateDb := types.DataRate{
+		Modulation:      dataRateIndexer.Modulation,
+		Bandwidth:       dataRateIndexer.Bandwidth,
+		SpreadingFactor: dataRateIndexer.SpreadingFactor,
+		Bitrate:         dataRateIndexer.Bitrate,
+	}
+	err := db.FirstOrCreate(&dataRateDb, &dataRateDb).Error
+	if err != nil {
+		return 0, err
+	}
+	dataRateDbCache.Set(dataRateIndexer, dataRateDb.ID)
+	return dataRateDb.ID, nil
+}
+
+func getFrequencyHerz(frequencyID uint) (uint64, error) {
+	herz, ok := frequencyDbCache.Get(frequencyID)
+	if ok {
+		return herz, nil
+	}
+
+	var frequencyDb types.Frequency
+	err := db.First(&frequencyDb, frequencyID).Error
+	if err != nil {
+		return 0, err
+	}
+	frequencyDbCache.Set(frequencyID, frequencyDb.Herz)
+	return frequencyDb.Herz, nil
+}
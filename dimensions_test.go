@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCellDimensions(t *testing.T) {
+	defer func(byDataRate bool, bands []FrequencyBand) {
+		myConfiguration.AggregateByDataRate = byDataRate
+		myConfiguration.FrequencyBands = bands
+	}(myConfiguration.AggregateByDataRate, myConfiguration.FrequencyBands)
+
+	myConfiguration.AggregateByDataRate = false
+	myConfiguration.FrequencyBands = nil
+	if dimensions := cellDimensions(5, 868100000); len(dimensions) != 1 || dimensions[0] != (cellDimension{}) {
+		t.Fatalf("without dimensions only all packets should be counted, got %v", dimensions)
+	}
+
+	myConfiguration.AggregateByDataRate = true
+	myConfiguration.FrequencyBands = []FrequencyBand{{Name: "EU868", MinHz: 863000000, MaxHz: 870000000}}
+	dimensions := cellDimensions(5, 868100000)
+	want := []cellDimension{{}, {FrequencyBand: "EU868"}, {DataRateID: 5}, {DataRateID: 5, FrequencyBand: "EU868"}}
+	if len(dimensions) != len(want) {
+		t.Fatalf("got %v, want %v", dimensions, want)
+	}
+	for i := range want {
+		if dimensions[i] != want[i] {
+			t.Fatalf("got %v, want %v", dimensions, want)
+		}
+	}
+
+	// Frequencies outside the bands and unknown data rates are only counted with all packets
+	if dimensions := cellDimensions(0, 915000000); len(dimensions) != 1 {
+		t.Fatalf("got %v", dimensions)
+	}
+}
+
+func TestValidateFrequencyBands(t *testing.T) {
+	defer func(bands []FrequencyBand) { myConfiguration.FrequencyBands = bands }(myConfiguration.FrequencyBands)
+
+	eu868 := FrequencyBand{Name: "EU868", MinHz: 863000000, MaxHz: 870000000}
+	tests := []struct {
+		name  string
+		bands []FrequencyBand
+		valid bool
+	}{
+		{"none", nil, true},
+		{"valid", []FrequencyBand{eu868, {Name: "US915", MinHz: 902000000, MaxHz: 928000000}}, true},
+		{"single frequency", []FrequencyBand{{Name: "868.1", MinHz: 868100000, MaxHz: 868100000}}, true},
+		{"no name", []FrequencyBand{{MinHz: 863000000, MaxHz: 870000000}}, false},
+		{"duplicate name", []FrequencyBand{eu868, eu868}, false},
+		{"exponent parsed as zero", []FrequencyBand{{Name: "EU868", MinHz: 0, MaxHz: 870000000}}, false},
+		{"reversed", []FrequencyBand{{Name: "EU868", MinHz: 870000000, MaxHz: 863000000}}, false},
+	}
+	for _, test := range tests {
+		myConfiguration.FrequencyBands = test.bands
+		if err := validateFrequencyBands(); (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"sort"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// Experiments are mapped separately from the normal coverage, and are counted in their own grid cells. They are not
+// rebuilt when a gateway moves, as an experiment is a record of the coverage at the time it ran.
+
+// Experiment grid cells are identified by these columns, which have a unique index on them
+var experimentGridCellTable = cellTable{"experiment_grid_cells", []clause.Column{{Name: "experiment_id"}, {Name: "antenna_id"}, {Name: "x"}, {Name: "y"}, {Name: "z"}}}
+
+var experimentDbCache = experimentCache{newLruCache("experiment", 150, 24*time.Hour)}
+
+type experimentCache struct {
+	*lruCache
+}
+
+func (c experimentCache) Get(name string) (uint, bool) {
+	i, ok := c.lruCache.Get(name)
+	if !ok {
+		return 0, false
+	}
+	return i.(uint), true
+}
+
+func (c experimentCache) Set(name string, experimentID uint) {
+	c.lruCache.Set(name, experimentID)
+}
+
+func experimentGridCellsEnabled() bool {
+	return myConfiguration.ExperimentGridCellsEnabled && tileAggregationEnabled()
+}
+
+// getExperimentID returns the ID of an experiment, creating the experiment if it is new
+func getExperimentID(name string) (uint, error) {
+	i, ok := experimentDbCache.Get(name)
+	if ok {
+		return i, nil
+	}
+
+	experimentDb := types.Experiment{Name: name}
+	err := db.FirstOrCreate(&experimentDb, &experimentDb).Error
+	if err != nil {
+		return 0, err
+	}
+	experimentDbCache.Set(name, experimentDb.ID)
+	return experimentDb.ID, nil
+}
+
+// aggregateExperimentGateway adds a live experiment uplink to the experiment grid cells of one gateway that heard it,
+// like aggregateGateway
+func aggregateExperimentGateway(message types.TtnMapperUplinkMessage, gateway types.TtnMapperGateway, cells *liveCells) error {
+	if !CheckDistanceFromGateway(gateway, message) || !CheckPathLossFromGateway(gateway, message) {
+		return nil
+	}
+
+	antennaIndexer := types.AntennaIndexer{NetworkId: gateway.NetworkId, GatewayId: gateway.GatewayId, AntennaIndex: gateway.AntennaIndex}
+	antennaID, err := getAntennaID(antennaIndexer)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	experimentID, err := getExperimentID(message.Experiment)
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	gridCells, err := getGridCells(antennaID, message.Latitude, message.Longitude, []cellDimension{{}})
+	if err != nil {
+		// Out of range of the tiles
+		return nil
+	}
+	entryTime := uplinkTime(message)
+	for i := range gridCells {
+		incrementBucket(&gridCells[i].SignalBuckets, entryTime, gateway.Rssi, gatewaySignalRssi(gateway), gateway.Snr)
+	}
+	gridCells = smearGridCells(gridCells, message.Latitude, message.Longitude, messageLocationQuality(message).AccuracyMeters)
+
+	cells.mutex.Lock()
+	addExperimentGridCells(cells.experimentGridCells, experimentID, gridCells)
+	cells.mutex.Unlock()
+	return nil
+}
+
+// addExperimentGridCells adds the counts of the grid cells to the experiment grid cells of the experiment
+func addExperimentGridCells(experimentGridCells experimentGridCellMap, experimentID uint, gridCells []types.GridCell) {
+	for _, gridCell := range gridCells {
+		experimentGridCells.add(types.ExperimentGridCell{
+			ExperimentID:   experimentID,
+			AntennaID:      gridCell.AntennaID,
+			X:              gridCell.X,
+			Y:              gridCell.Y,
+			Z:              gridCell.Z,
+			BucketSchemaID: gridCell.BucketSchemaID,
+			SignalBuckets:  gridCell.SignalBuckets,
+		})
+	}
+}
+
+func experimentGridCellIndex(experimentGridCell types.ExperimentGridCell) types.ExperimentGridCellIndexer {
+	return types.ExperimentGridCellIndexer{
+		ExperimentId: experimentGridCell.ExperimentID,
+		AntennaId:    experimentGridCell.AntennaID,
+		X:            experimentGridCell.X,
+		Y:            experimentGridCell.Y,
+		Z:            experimentGridCell.Z,
+	}
+}
+
+type experimentGridCellMap map[types.ExperimentGridCellIndexer]types.ExperimentGridCell
+
+// add sums the counts of experimentGridCell into the cell with the same index
+func (m experimentGridCellMap) add(experimentGridCell types.ExperimentGridCell) {
+	experimentGridCellIndexer := experimentGridCellIndex(experimentGridCell)
+	existing, ok := m[experimentGridCellIndexer]
+	if ok {
+		addSignalBuckets(&existing.SignalBuckets, experimentGridCell.SignalBuckets)
+		m[experimentGridCellIndexer] = existing
+	} else {
+		m[experimentGridCellIndexer] = experimentGridCell
+	}
+}
+
+func (m experimentGridCellMap) table() cellTable { return experimentGridCellTable }
+func (m experimentGridCellMap) size() int        { return len(m) }
+
+func (m experimentGridCellMap) sorted() interface{} {
+	experimentGridCells := make([]types.ExperimentGridCell, 0, len(m))
+	for _, experimentGridCell := range m {
+		experimentGridCells = append(experimentGridCells, experimentGridCell)
+	}
+
+	sort.Slice(experimentGridCells, func(i, j int) bool {
+		a, b := experimentGridCells[i], experimentGridCells[j]
+		if a.ExperimentID != b.ExperimentID {
+			return a.ExperimentID < b.ExperimentID
+		}
+		if a.AntennaID != b.AntennaID {
+			return a.AntennaID < b.AntennaID
+		}
+		if a.Z != b.Z {
+			return a.Z < b.Z
+		}
+		if a.X != b.X {
+			return a.X < b.X
+		}
+		return a.Y < b.Y
+	})
+	return &experimentGridCells
+}
+
+func ReprocessExperiments(names []string) {
+	for _, name := range names {
+		if isStopping() {
+			return
+		}
+		var experiment types.Experiment
+		if err := db.Where("name = ?", name).First(&experiment).Error; err != nil {
+			log.Println(name, "-", err.Error())
+			continue
+		}
+		if err := ReprocessExperiment(experiment); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// ReprocessExperiment rebuilds all experiment grid cells of an experiment from its packets
+func ReprocessExperiment(experiment types.Experiment) error {
+	if !experimentGridCellsEnabled() {
+		return errors.New("experiment grid cells are not enabled")
+	}
+
+	log.Print("Experiment ", experiment.ID, " ", experiment.Name)
+
+	// Write out pending live increments first, so that they are not added on top of the rebuilt cells afterwards
+	if err := gridCellWriteBuffer.Flush(); err != nil {
+		return err
+	}
+
+	experimentCells := experimentGridCellMap{}
+	antennas := map[uint]types.Antenna{}
+
+	rows, err := db.Model(&types.Packet{}).Where("experiment_id = ?", experiment.ID).Rows() // server side cursor
+	if err != nil {
+		return err
+	}
+
+	i := 0
+	for rows.Next() {
+		if isStopping() {
+			rows.Close()
+			return errShuttingDown
+		}
+		i++
+		oldDataProcessed.Inc()
+		fmt.Printf("\rPacket %d   ", i)
+
+		var packet types.Packet
+		if err := db.ScanRows(rows, &packet); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		accept, err := acceptPacketLocationQuality(packet)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if !accept {
+			continue
+		}
+		blocked, err := packetDeviceBlocked(packet)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if blocked {
+			continue
+		}
+
+		antenna, ok := antennas[packet.AntennaID]
+		if !ok {
+			if err := db.First(&antenna, packet.AntennaID).Error; err != nil {
+				rows.Close()
+				return err
+			}
+			antennas[packet.AntennaID] = antenna
+		}
+		if !CheckDistanceFromAntenna(antenna, packet) {
+			continue
+		}
+		plausible, err := CheckPathLossFromAntenna(antenna, packet)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if !plausible {
+			continue
+		}
+
+		gridCells, err := getGridCells(antenna.ID, packet.Latitude, packet.Longitude, []cellDimension{{}})
+		if err != nil {
+			continue
+		}
+		for j := range gridCells {
+			incrementBucket(&gridCells[j].SignalBuckets, packet.Time, packet.Rssi, packet.SignalRssi, packet.Snr)
+		}
+		gridCells = smearGridCells(gridCells, packet.Latitude, packet.Longitude, packet.AccuracyMeters)
+		addExperimentGridCells(experimentCells, experiment.ID, gridCells)
+	}
+	err = rows.Close()
+	if err != nil {
+		log.Println(err.Error())
+	}
+	if i > 0 {
+		fmt.Println()
+	}
+	log.Printf("Result is %d experiment grid cells", len(experimentCells))
+
+	// Replace the old cells in one transaction, like ReprocessAntenna
+	var deleted int64
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where(&types.ExperimentGridCell{ExperimentID: experiment.ID}).Delete(&types.ExperimentGridCell{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return storeCellsInDb(tx, experimentCells)
+	})
+	if err != nil {
+		return err
+	}
+	deletedGridCells.Add(float64(deleted))
+	return nil
+}
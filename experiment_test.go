@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+func TestAddExperimentGridCells(t *testing.T) {
+	gridCells, err := getGridCells(1, 52.0, 5.0, []cellDimension{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range gridCells {
+		incrementBucket(&gridCells[i].SignalBuckets, time.Now(), -90, nil, 5)
+	}
+
+	experimentCells := map[types.ExperimentGridCellIndexer]types.ExperimentGridCell{}
+	addExperimentGridCells(experimentCells, 7, gridCells)
+	addExperimentGridCells(experimentCells, 7, gridCells)
+	addExperimentGridCells(experimentCells, 8, gridCells)
+
+	if len(experimentCells) != 2*len(gridCells) {
+		t.Fatalf("got %d cells, want %d", len(experimentCells), 2*len(gridCells))
+	}
+	for index, cell := range experimentCells {
+		want := uint32(2)
+		if index.ExperimentId == 8 {
+			want = 1
+		}
+		if cell.BucketHigh != want {
+			t.Errorf("experiment %d: got %d packets, want %d", index.ExperimentId, cell.BucketHigh, want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// gatewayLocation returns the location of a gateway at the given time. A location forced by an operator takes
+// precedence over the one reported by the network, so that wrong gateway coordinates can be corrected. A forced
+// location of 0,0 blacklists the gateway, which is returned as 0,0 just like a gateway without a known location.
+// Otherwise the location the gateway was installed at, at that time, is used, so that old packets are compared
+// against where the gateway was back then. Before the first location in the history, where the gateway was is
+// unknown, and 0,0 is returned. Only a gateway without any history is at its current location.
+func gatewayLocation(gatewayIndexer types.GatewayIndexer, at time.Time) (latitude float64, longitude float64, err error) {
+	force, err := getGatewayLocationForce(gatewayIndexer)
+	if err != nil {
+		return 0, 0, err
+	}
+	if force != nil {
+		return force.Latitude, force.Longitude, nil
+	}
+
+	locations, err := getGatewayLocations(gatewayIndexer)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Index of the first location installed after the given time, the one before it was valid at that time
+	i := sort.Search(len(locations), func(i int) bool {
+		return locations[i].InstalledAt.After(at)
+	})
+	if i > 0 {
+		return locations[i-1].Latitude, locations[i-1].Longitude, nil
+	}
+	if len(locations) > 0 {
+		return 0, 0, nil
+	}
+
+	gatewayDb, err := getGateway(gatewayIndexer)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if gatewayDb.Latitude != nil {
+		latitude = *gatewayDb.Latitude
+	}
+	if gatewayDb.Longitude != nil {
+		longitude = *gatewayDb.Longitude
+	}
+	return latitude, longitude, nil
+}
+
+func getGateway(gatewayIndexer types.GatewayIndexer) (types.Gateway, error) {
+	gatewayDb, ok := gatewayDbCache.Get(gatewayIndexer)
+	if ok {
+		//log.Println("Gateway from cache")
+		return gatewayDb, nil
+	}
+
+	gatewayDb = types.Gateway{NetworkId: gatewayIndexer.NetworkId, GatewayId: gatewayIndexer.GatewayId}
+	//log.Println("Gateway from DB")
+	err := db.First(&gatewayDb, &gatewayDb).Error
+	if err != nil {
+		return gatewayDb, err
+	}
+	if gatewayDb.ID != 0 {
+		gatewayDbCache.Set(gatewayIndexer, gatewayDb)
+	}
+	return gatewayDb, nil
+}
+
+// getGatewayLocationForce returns the forced location of a gateway, or nil if there is none
+func getGatewayLocationForce(gatewayIndexer types.GatewayIndexer) (*types.GatewayLocationForce, error) {
+	force, ok := gatewayForceDbCache.Get(gatewayIndexer)
+	if ok {
+		return force, nil
+	}
+
+	var forces []types.GatewayLocationForce
+	err := db.Where(&types.GatewayLocationForce{NetworkId: gatewayIndexer.NetworkId, GatewayId: gatewayIndexer.GatewayId}).
+		Limit(1).Find(&forces).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(forces) > 0 {
+		force = &forces[0]
+	}
+	gatewayForceDbCache.Set(gatewayIndexer, force)
+	return force, nil
+}
+
+// getGatewayLocations returns the location history of a gateway, sorted by installation time
+func getGatewayLocations(gatewayIndexer types.GatewayIndexer) ([]types.GatewayLocation, error) {
+	locations, ok := gatewayLocationsDbCache.Get(gatewayIndexer)
+	if ok {
+		return locations, nil
+	}
+
+	err := db.Where("network_id = ? AND gateway_id = ?", gatewayIndexer.NetworkId, gatewayIndexer.GatewayId).
+		Order("installed_at asc").Find(&locations).Error
+	if err != nil {
+		return nil, err
+	}
+
+	gatewayLocationsDbCache.Set(gatewayIndexer, locations)
+	return locations, nil
+}
+
+// forgetGateway drops the cached location of a gateway, so that the next lookup reads it from the database
+func forgetGateway(gatewayIndexer types.GatewayIndexer) {
+	gatewayDbCache.Delete(gatewayIndexer)
+	gatewayForceDbCache.Delete(gatewayIndexer)
+	gatewayLocationsDbCache.Delete(gatewayIndexer)
+}
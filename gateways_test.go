@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// cacheGatewayLocations fills the gateway caches, so that gatewayLocation does not need the database
+func cacheGatewayLocations(t *testing.T, gatewayIndexer types.GatewayIndexer, force *types.GatewayLocationForce, locations []types.GatewayLocation, gateway types.Gateway) {
+	useUnreachableDb(t)
+	gatewayForceDbCache.Set(gatewayIndexer, force)
+	gatewayLocationsDbCache.Set(gatewayIndexer, locations)
+	gatewayDbCache.Set(gatewayIndexer, gateway)
+	t.Cleanup(func() { forgetGateway(gatewayIndexer) })
+}
+
+func TestGatewayLocationForce(t *testing.T) {
+	gatewayIndexer := types.GatewayIndexer{NetworkId: "thethingsnetwork.org", GatewayId: "eui-force"}
+	installedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	latitude, longitude := 52.0, 5.0
+	force := &types.GatewayLocationForce{Latitude: 51.0, Longitude: 4.0}
+	locations := []types.GatewayLocation{{InstalledAt: installedAt, Latitude: 50.0, Longitude: 3.0}}
+	cacheGatewayLocations(t, gatewayIndexer, force, locations, types.Gateway{ID: 1, Latitude: &latitude, Longitude: &longitude})
+
+	// The forced location overrides both the history and the current location
+	gotLatitude, gotLongitude, err := gatewayLocation(gatewayIndexer, installedAt.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotLatitude != 51.0 || gotLongitude != 4.0 {
+		t.Fatalf("got %f,%f, want the forced location", gotLatitude, gotLongitude)
+	}
+
+	// Forcing 0,0 blacklists the gateway
+	force.Latitude, force.Longitude = 0, 0
+	gateway := types.TtnMapperGateway{NetworkId: gatewayIndexer.NetworkId, GatewayId: gatewayIndexer.GatewayId}
+	message := types.TtnMapperUplinkMessage{Latitude: 52.0, Longitude: 5.0, Time: installedAt.Add(time.Hour).UnixNano()}
+	if _, ok := gatewayDistanceKm(gateway, message); ok {
+		t.Fatal("blacklisted gateway has a distance")
+	}
+}
+
+func TestGatewayLocationHistory(t *testing.T) {
+	gatewayIndexer := types.GatewayIndexer{NetworkId: "thethingsnetwork.org", GatewayId: "eui-history"}
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(30 * 24 * time.Hour)
+	latitude, longitude := 52.0, 5.0
+	locations := []types.GatewayLocation{
+		{InstalledAt: first, Latitude: 50.0, Longitude: 3.0},
+		{InstalledAt: second, Latitude: 51.0, Longitude: 4.0},
+	}
+	cacheGatewayLocations(t, gatewayIndexer, nil, locations, types.Gateway{ID: 1, Latitude: &latitude, Longitude: &longitude})
+
+	tests := []struct {
+		name          string
+		at            time.Time
+		wantLatitude  float64
+		wantLongitude float64
+	}{
+		{"before the first location", first.Add(-time.Hour), 0, 0},
+		{"installed", first, 50.0, 3.0},
+		{"between moves", first.Add(time.Hour), 50.0, 3.0},
+		{"moved", second, 51.0, 4.0},
+		{"after the last move", second.Add(time.Hour), 51.0, 4.0},
+	}
+	for _, test := range tests {
+		gotLatitude, gotLongitude, err := gatewayLocation(gatewayIndexer, test.at)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if gotLatitude != test.wantLatitude || gotLongitude != test.wantLongitude {
+			t.Errorf("%s: got %f,%f, want %f,%f", test.name, gotLatitude, gotLongitude, test.wantLatitude, test.wantLongitude)
+		}
+	}
+
+	// Without any history, the gateway has always been at its current location
+	unmoved := types.GatewayIndexer{NetworkId: "thethingsnetwork.org", GatewayId: "eui-unmoved"}
+	cacheGatewayLocations(t, unmoved, nil, nil, types.Gateway{ID: 2, Latitude: &latitude, Longitude: &longitude})
+	gotLatitude, gotLongitude, err := gatewayLocation(unmoved, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotLatitude != latitude || gotLongitude != longitude {
+		t.Errorf("got %f,%f, want the current location", gotLatitude, gotLongitude)
+	}
+}
+
+func TestForgetGateway(t *testing.T) {
+	gatewayIndexer := types.GatewayIndexer{NetworkId: "NS_TTS_V3://ttn@000013", GatewayId: "eui-forget"}
+	latitude, longitude := 52.0, 5.0
+	cacheGatewayLocations(t, gatewayIndexer, nil, nil, types.Gateway{ID: 1, Latitude: &latitude, Longitude: &longitude})
+
+	forgetGateway(gatewayIndexer)
+	if _, ok := gatewayDbCache.Get(gatewayIndexer); ok {
+		t.Error("gateway still cached")
+	}
+	if _, ok := gatewayForceDbCache.Get(gatewayIndexer); ok {
+		t.Error("forced location still cached")
+	}
+	if _, ok := gatewayLocationsDbCache.Get(gatewayIndexer); ok {
+		t.Error("location history still cached")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm/clause"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// H3 cells are resolved by the h3 extension in Postgres, as there is no pure Go implementation of H3
+
+const (
+	aggregationBackendTile = "tile"
+	aggregationBackendH3   = "h3"
+	aggregationBackendBoth = "both"
+
+	// Number of coordinates resolved to H3 cells in one query during reprocessing
+	h3ResolveBatchSize = 1000
+
+	// Coordinates are rounded to about 10 cm before they are resolved, well below the size of the finest H3 cells
+	h3CoordinatePrecision = 1e6
+	h3MaxResolution       = 15
+)
+
+var h3IndexDbCache = h3IndexCache{newLruCache("h3_index", 150, 24*time.Hour)}
+
+// H3 cells are identified by these columns, which have a unique index on them
+var h3CellTable = cellTable{"h3_cells", []clause.Column{{Name: "antenna_id"}, {Name: "resolution"}, {Name: "h3_index"}, {Name: "data_rate_id"}, {Name: "frequency_band"}}}
+
+func tileAggregationEnabled() bool {
+	return myConfiguration.AggregationBackend != aggregationBackendH3
+}
+
+func h3AggregationEnabled() bool {
+	return myConfiguration.AggregationBackend == aggregationBackendH3 ||
+		myConfiguration.AggregationBackend == aggregationBackendBoth
+}
+
+func validateAggregationBackend() error {
+	switch myConfiguration.AggregationBackend {
+	case aggregationBackendTile, aggregationBackendH3, aggregationBackendBoth:
+	default:
+		return errors.New("unknown aggregation backend " + myConfiguration.AggregationBackend)
+	}
+	if !h3AggregationEnabled() {
+		return nil
+	}
+	if len(myConfiguration.H3Resolutions) == 0 {
+		return errors.New("no h3 resolutions configured")
+	}
+	for _, resolution := range myConfiguration.H3Resolutions {
+		if resolution < 0 || resolution > h3MaxResolution {
+			return fmt.Errorf("h3 resolution %d is not between 0 and %d", resolution, h3MaxResolution)
+		}
+	}
+	return nil
+}
+
+// h3Point is a coordinate to resolve to H3 cells
+type h3Point struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// newH3Point rounds the coordinate, so that the cache is hit by points that are practically the same, and the live
+// and reprocessed cells of a point always agree
+func newH3Point(latitude float64, longitude float64) h3Point {
+	return h3Point{
+		Latitude:  math.Round(latitude*h3CoordinatePrecision) / h3CoordinatePrecision,
+		Longitude: math.Round(longitude*h3CoordinatePrecision) / h3CoordinatePrecision,
+	}
+}
+
+type h3IndexCache struct {
+	*lruCache
+}
+
+func (c h3IndexCache) Get(point h3Point) ([]int64, bool) {
+	i, ok := c.lruCache.Get(point)
+	if !ok {
+		return nil, false
+	}
+	return i.([]int64), true
+}
+
+func (c h3IndexCache) Set(point h3Point, indexes []int64) {
+	c.lruCache.Set(point, indexes)
+}
+
+// getH3Cells returns an empty H3 cell for every configured resolution and every dimension, for the cells containing
+// the coordinates
+func getH3Cells(antennaId uint, latitude float64, longitude float64, dimensions []cellDimension) ([]types.H3Cell, error) {
+	if latitude == 0 && longitude == 0 {
+		return nil, errors.New("null island")
+	}
+
+	point := newH3Point(latitude, longitude)
+	indexes, ok := h3IndexDbCache.Get(point)
+	if !ok {
+		resolved, err := resolveH3Indexes([]h3Point{point})
+		if err != nil {
+			return nil, err
+		}
+		indexes = resolved[0]
+		h3IndexDbCache.Set(point, indexes)
+	}
+
+	return h3CellsForIndexes(antennaId, indexes, dimensions), nil
+}
+
+func h3CellsForIndexes(antennaId uint, indexes []int64, dimensions []cellDimension) []types.H3Cell {
+	h3Cells := make([]types.H3Cell, 0, len(indexes)*len(dimensions))
+	for i, resolution := range myConfiguration.H3Resolutions {
+		for _, dimension := range dimensions {
+			h3Cells = append(h3Cells, types.H3Cell{
+				AntennaID:      antennaId,
+				Resolution:     resolution,
+				H3Index:        indexes[i],
+				DataRateID:     dimension.DataRateID,
+				FrequencyBand:  dimension.FrequencyBand,
+				BucketSchemaID: bucketSchemaID,
+			})
+		}
+	}
+	return h3Cells
+}
+
+// resolveH3Indexes looks up the H3 index of every point at every configured resolution in a single query. The
+// result has the same order as points, with the indexes in the order of the configured resolutions.
+func resolveH3Indexes(points []h3Point) ([][]int64, error) {
+	if len(points) == 0 {
+		return nil, nil
+	}
+
+	// The resolutions come from our own configuration, so they are safe to put in the query
+	columns := make([]string, 0, len(myConfiguration.H3Resolutions))
+	for _, resolution := range myConfiguration.H3Resolutions {
+		columns = append(columns, "h3_lat_lng_to_cell(POINT(p.lon, p.lat), "+strconv.Itoa(resolution)+")::bigint")
+	}
+
+	values := make([]string, 0, len(points))
+	args := make([]interface{}, 0, 2*len(points))
+	for i, point := range points {
+		values = append(values, "("+strconv.Itoa(i)+", ?::float8, ?::float8)")
+		args = append(args, point.Longitude, point.Latitude)
+	}
+
+	query := "SELECT p.i, " + strings.Join(columns, ", ") +
+		" FROM (VALUES " + strings.Join(values, ", ") + ") AS p(i, lon, lat) ORDER BY p.i"
+
+	rows, err := db.Raw(query, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([][]int64, 0, len(points))
+	for rows.Next() {
+		var i int
+		indexes := make([]int64, len(myConfiguration.H3Resolutions))
+		dest := []interface{}{&i}
+		for j := range indexes {
+			dest = append(dest, &indexes[j])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result = append(result, indexes)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) != len(points) {
+		return nil, errors.New("not all points resolved to h3 cells")
+	}
+
+	return result, nil
+}
+
+func h3CellIndex(h3Cell types.H3Cell) types.H3CellIndexer {
+	return types.H3CellIndexer{
+		AntennaId:     h3Cell.AntennaID,
+		Resolution:    h3Cell.Resolution,
+		H3Index:       h3Cell.H3Index,
+		DataRateId:    h3Cell.DataRateID,
+		FrequencyBand: h3Cell.FrequencyBand,
+	}
+}
+
+type h3CellMap map[types.H3CellIndexer]types.H3Cell
+
+// add sums the counts of h3Cell into the cell with the same index
+func (m h3CellMap) add(h3Cell types.H3Cell) {
+	h3CellIndexer := h3CellIndex(h3Cell)
+	existing, ok := m[h3CellIndexer]
+	if ok {
+		addSignalBuckets(&existing.SignalBuckets, h3Cell.SignalBuckets)
+		m[h3CellIndexer] = existing
+	} else {
+		m[h3CellIndexer] = h3Cell
+	}
+}
+
+func (m h3CellMap) table() cellTable { return h3CellTable }
+func (m h3CellMap) size() int        { return len(m) }
+
+func (m h3CellMap) sorted() interface{} {
+	h3Cells := make([]types.H3Cell, 0, len(m))
+	for _, h3Cell := range m {
+		h3Cells = append(h3Cells, h3Cell)
+	}
+
+	sort.Slice(h3Cells, func(i, j int) bool {
+		a, b := h3Cells[i], h3Cells[j]
+		if a.AntennaID != b.AntennaID {
+			return a.AntennaID < b.AntennaID
+		}
+		if a.Resolution != b.Resolution {
+			return a.Resolution < b.Resolution
+		}
+		if a.H3Index != b.H3Index {
+			return a.H3Index < b.H3Index
+		}
+		if a.DataRateID != b.DataRateID {
+			return a.DataRateID < b.DataRateID
+		}
+		return a.FrequencyBand < b.FrequencyBand
+	})
+	return &h3Cells
+}
+
+// h3Batch collects reprocessed packets, so that their H3 cells can be resolved in one query per batch instead of
+// one query per packet
+type h3Batch struct {
+	antennaId uint
+	pending   []h3PendingPacket
+	h3Cells   h3CellMap
+}
+
+type h3PendingPacket struct {
+	packet   types.Packet
+	noSignal bool // the antenna did not hear this packet
+}
+
+func newH3Batch(antennaId uint) *h3Batch {
+	return &h3Batch{antennaId: antennaId, h3Cells: h3CellMap{}}
+}
+
+func (b *h3Batch) Add(packet types.Packet) error {
+	return b.add(h3PendingPacket{packet: packet})
+}
+
+// AddNoSignal adds a packet that the antenna did not hear
+func (b *h3Batch) AddNoSignal(packet types.Packet) error {
+	return b.add(h3PendingPacket{packet: packet, noSignal: true})
+}
+
+func (b *h3Batch) add(pending h3PendingPacket) error {
+	if pending.packet.Latitude == 0 && pending.packet.Longitude == 0 {
+		return nil
+	}
+	b.pending = append(b.pending, pending)
+	if len(b.pending) >= h3ResolveBatchSize {
+		return b.Resolve()
+	}
+	return nil
+}
+
+// Resolve adds the pending packets to the H3 cells
+func (b *h3Batch) Resolve() error {
+	points := make([]h3Point, 0, len(b.pending))
+	for _, pending := range b.pending {
+		points = append(points, newH3Point(pending.packet.Latitude, pending.packet.Longitude))
+	}
+
+	indexes, err := resolveH3Indexes(points)
+	if err != nil {
+		return err
+	}
+
+	for i, pending := range b.pending {
+		dimensions, err := packetDimensions(pending.packet)
+		if err != nil {
+			return err
+		}
+		for _, h3Cell := range h3CellsForIndexes(b.antennaId, indexes[i], dimensions) {
+			if pending.noSignal {
+				incrementNoSignal(&h3Cell.SignalBuckets, pending.packet.Time)
+			} else {
+				incrementBucket(&h3Cell.SignalBuckets, pending.packet.Time, pending.packet.Rssi, pending.packet.SignalRssi, pending.packet.Snr)
+			}
+			b.h3Cells.add(h3Cell)
+		}
+	}
+	b.pending = b.pending[:0]
+	return nil
+}
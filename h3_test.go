@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateAggregationBackend(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+
+	tests := []struct {
+		backend     string
+		resolutions []int
+		valid       bool
+	}{
+		{aggregationBackendTile, nil, true},
+		{aggregationBackendH3, []int{0, 10, 15}, true},
+		{aggregationBackendBoth, []int{10}, true},
+		{"hexagon", []int{10}, false},
+		{aggregationBackendH3, nil, false},
+		{aggregationBackendH3, []int{16}, false},
+		{aggregationBackendBoth, []int{-1}, false},
+	}
+	for _, test := range tests {
+		myConfiguration.AggregationBackend = test.backend
+		myConfiguration.H3Resolutions = test.resolutions
+		if err := validateAggregationBackend(); (err == nil) != test.valid {
+			t.Errorf("%s %v: got %v, want valid %v", test.backend, test.resolutions, err, test.valid)
+		}
+	}
+}
+
+func TestNewH3Point(t *testing.T) {
+	// Fixes of the same location that only differ in noise share a cache entry
+	a := newH3Point(52.123456701, 5.123456749)
+	b := newH3Point(52.123456699, 5.123456651)
+	if a != b {
+		t.Fatalf("%+v and %+v differ", a, b)
+	}
+	if a.Latitude != 52.123457 || a.Longitude != 5.123457 {
+		t.Fatalf("got %+v", a)
+	}
+}
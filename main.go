@@ -11,6 +11,7 @@ import (
 	"gorm.io/gorm/logger"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 	"ttnmapper-postgres-insert-gridcell/types"
 )
@@ -24,6 +25,11 @@ type Configuration struct {
 	AmqpQueueInsertedData    string `env:"AMQP_QUEUE_INSERTED"`
 	AmqpExchangeGatewayMoved string `env:"AMQP_EXCHANGE_GATEWAY_MOVED"`
 	AmqpQueueGatewayMoved    string `env:"AMQP_QUEUE_GATEWAY_MOVED"`
+	AmqpManualAck            bool   `env:"AMQP_MANUAL_ACK"`           // Durable queues, ack only after grid cells are stored
+	AmqpExchangeDeadLetter   string `env:"AMQP_EXCHANGE_DEAD_LETTER"` // Failed messages are republished here, empty to disable
+	AmqpQueueDeadLetter      string `env:"AMQP_QUEUE_DEAD_LETTER"`
+	AmqpMaxAttempts          int    `env:"AMQP_MAX_ATTEMPTS"` // Attempts before a message is dead lettered
+	AmqpPrefetchCount        int    `env:"AMQP_PREFETCH_COUNT"`
 
 	PostgresHost     string `env:"POSTGRES_HOST"`
 	PostgresPort     string `env:"POSTGRES_PORT"`
@@ -35,6 +41,70 @@ type Configuration struct {
 	PrometheusPort string `env:"PROMETHEUS_PORT"`
 
 	GatewayMaximumRangeKm float64 `env:"GATEWAY_MAX_RANGE"`
+	// Maximum range of the networks with an ID starting with a prefix, the longest matching prefix wins. The
+	// gateway_range_overrides table overrides both for single gateways.
+	NetworkMaximumRanges []NetworkRange `env:"NETWORK_MAX_RANGES"`
+
+	// Also split the cells by data rate and/or frequency band, next to the cells counting all packets. Rebuild all
+	// antennas after changing these.
+	AggregateByDataRate bool            `env:"AGGREGATE_BY_DATA_RATE"`
+	FrequencyBands      []FrequencyBand `env:"FREQUENCY_BANDS"` // empty to not split by band
+
+	// Also keep decayed weights of the buckets with this half life, 0 to disable. Rebuild all antennas after changing.
+	DecayHalfLifeDays float64 `env:"DECAY_HALF_LIFE_DAYS"`
+
+	// Signal metric counted in the buckets, and the lower edges of the bands from BucketHigh to Bucket145. Rebuild
+	// all antennas after changing these, as cells counted differently are not updated.
+	SignalMetric      string    `env:"SIGNAL_METRIC"`
+	SignalBucketEdges []float64 `env:"SIGNAL_BUCKET_EDGES"`
+
+	// Count uplinks that nearby antennas of the same network did not hear in the no signal bucket
+	NoSignalEnabled bool `env:"NO_SIGNAL_ENABLED"`
+
+	LiveWorkers int `env:"LIVE_WORKERS"` // Live gateways are sharded over this many workers by antenna
+
+	CacheMemoryBudgetMb    int `env:"CACHE_MEMORY_BUDGET_MB"` // Shared equally between all lookup caches
+	AntennaCacheTtlSeconds int `env:"ANTENNA_CACHE_TTL_SECONDS"`
+	DeviceCacheTtlSeconds  int `env:"DEVICE_CACHE_TTL_SECONDS"` // How long a change to the blocked devices takes to apply
+	GatewayCacheTtlSeconds int `env:"GATEWAY_CACHE_TTL_SECONDS"`
+
+	// Zoom levels to aggregate grid cells at. Rebuild all antennas after adding a level.
+	GridCellZoomLevels []int `env:"GRIDCELL_ZOOM_LEVELS"`
+
+	// Also count the grid cells per "day", "week" or "month" for coverage trends, empty to disable. Periods that ended
+	// longer than the retention ago are deleted, 0 keeps them forever.
+	PeriodGranularity   string `env:"PERIOD_GRANULARITY"`
+	PeriodRetentionDays int    `env:"PERIOD_RETENTION_DAYS"`
+
+	// Quality gate for the location of points, 0 or empty to not check. Points that do not report a value pass.
+	MaxAccuracyMeters       float64  `env:"MAX_ACCURACY_METERS"`
+	MaxHdop                 float64  `env:"MAX_HDOP"`
+	MinSatellites           int32    `env:"MIN_SATELLITES"`
+	ExcludedAccuracySources []string `env:"EXCLUDED_ACCURACY_SOURCES"` // like "ip" to leave out IP geolocation
+
+	// Leave out points received stronger than possible at their distance from the gateway, with a transmitter at the
+	// maximum EIRP and the path loss growing with the exponent (2 for free space) from the free space loss at 1 km
+	PathLossFilterEnabled bool    `env:"PATH_LOSS_FILTER_ENABLED"`
+	PathLossMaxEirpDbm    float64 `env:"PATH_LOSS_MAX_EIRP_DBM"`
+	PathLossExponent      float64 `env:"PATH_LOSS_EXPONENT"`
+	PathLossMarginDb      float64 `env:"PATH_LOSS_MARGIN_DB"`
+
+	// Spread points over their accuracy circle: "fraction" adds the fraction of the circle in every cell covered to
+	// the weights, "coarsest" only counts them at zoom levels with tiles as wide as the circle. Empty to disable.
+	// Rebuild all antennas after changing.
+	SmearMode string `env:"SMEAR_MODE"`
+
+	// Also count experiments in their own grid cells, instead of ignoring them
+	ExperimentGridCellsEnabled bool `env:"EXPERIMENT_GRID_CELLS_ENABLED"`
+
+	// Aggregate on slippy map tiles ("tile"), H3 hexagons ("h3"), or both. H3 needs the h3 Postgres extension.
+	AggregationBackend string `env:"AGGREGATION_BACKEND"`
+	H3Resolutions      []int  `env:"H3_RESOLUTIONS"`
+
+	GridCellBufferSize         int `env:"GRIDCELL_BUFFER_SIZE"` // 0 writes every live update directly
+	GridCellBufferFlushSeconds int `env:"GRIDCELL_BUFFER_FLUSH_SECONDS"`
+
+	ShutdownTimeoutSeconds int `env:"SHUTDOWN_TIMEOUT_SECONDS"`
 }
 
 var myConfiguration = Configuration{
@@ -46,6 +116,11 @@ var myConfiguration = Configuration{
 	AmqpQueueInsertedData:    "inserted_data_gridcell",
 	AmqpExchangeGatewayMoved: "gateway_moved",
 	AmqpQueueGatewayMoved:    "gateway_moved_gridcell",
+	AmqpManualAck:            false,
+	AmqpExchangeDeadLetter:   "",
+	AmqpQueueDeadLetter:      "gridcell_dead_letter",
+	AmqpMaxAttempts:          2,
+	AmqpPrefetchCount:        10,
 
 	PostgresHost:     "localhost",
 	PostgresPort:     "5432",
@@ -57,6 +132,51 @@ var myConfiguration = Configuration{
 	PrometheusPort: "9100",
 
 	GatewayMaximumRangeKm: 200,
+	NetworkMaximumRanges:  []NetworkRange{},
+
+	AggregateByDataRate: false,
+	FrequencyBands:      []FrequencyBand{},
+
+	DecayHalfLifeDays: 0,
+
+	SignalMetric:      signalMetricRssiSnr,
+	SignalBucketEdges: legacyBucketEdges,
+
+	NoSignalEnabled: false,
+
+	LiveWorkers: 1,
+
+	CacheMemoryBudgetMb:    64,
+	AntennaCacheTtlSeconds: 24 * 60 * 60,
+	GatewayCacheTtlSeconds: 60 * 60,
+	DeviceCacheTtlSeconds:  5 * 60,
+
+	GridCellZoomLevels: []int{19},
+
+	PeriodGranularity:   "",
+	PeriodRetentionDays: 0,
+
+	MaxAccuracyMeters:       0,
+	MaxHdop:                 0,
+	MinSatellites:           0,
+	ExcludedAccuracySources: []string{},
+
+	PathLossFilterEnabled: false,
+	PathLossMaxEirpDbm:    30,
+	PathLossExponent:      2,
+	PathLossMarginDb:      10,
+
+	SmearMode: "",
+
+	ExperimentGridCellsEnabled: false,
+
+	AggregationBackend: "tile",
+	H3Resolutions:      []int{10},
+
+	GridCellBufferSize:         1000,
+	GridCellBufferFlushSeconds: 5,
+
+	ShutdownTimeoutSeconds: 30,
 }
 
 var (
@@ -81,6 +201,31 @@ var (
 		Name: "ttnmapper_gridcell_updated_count",
 		Help: "The total number of grid cells updated in database",
 	})
+	noSignalUplinks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ttnmapper_gridcell_no_signal_count",
+		Help: "The total number of uplinks counted as not heard by a nearby antenna",
+	})
+	bucketSchemaSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ttnmapper_gridcell_bucket_schema_skipped_count",
+		Help: "The total number of cell updates skipped because the stored cell uses a different bucket schema",
+	})
+	rejectedPoints = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ttnmapper_gridcell_rejected_points_count",
+		Help: "The total number of points left out because of the quality of their location, an implausible signal or a blocked device",
+	}, []string{"reason"})
+	deadLetteredMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ttnmapper_gridcell_dead_lettered_count",
+		Help: "The total number of messages moved to the dead letter exchange",
+	}, []string{"stage"})
+
+	amqpReconnectAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ttnmapper_gridcell_amqp_reconnect_attempts_count",
+		Help: "The total number of attempts to reconnect to the AMQP broker",
+	}, []string{"exchange"})
+	amqpConnectFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ttnmapper_gridcell_amqp_connect_failures_count",
+		Help: "The total number of AMQP connections or subscriptions that failed or were lost",
+	}, []string{"exchange"})
 
 	processLiveDuration = promauto.NewHistogram(prometheus.HistogramOpts{
 		Name:    "ttnmapper_gridcell_live_duration",
@@ -93,6 +238,33 @@ var (
 		Buckets: []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 1.5, 2, 5, 10, 100, 1000, 10000},
 	})
 
+	cacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ttnmapper_gridcell_cache_hit_count",
+		Help: "The total number of lookups found in the cache",
+	}, []string{"cache"})
+	cacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ttnmapper_gridcell_cache_miss_count",
+		Help: "The total number of lookups not found in the cache",
+	}, []string{"cache"})
+	cacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ttnmapper_gridcell_cache_eviction_count",
+		Help: "The total number of cache entries removed because the cache was full or the entry expired",
+	}, []string{"cache", "reason"})
+	cacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ttnmapper_gridcell_cache_entries",
+		Help: "The number of entries in the cache",
+	}, []string{"cache"})
+
+	gridCellBufferDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ttnmapper_gridcell_buffer_depth",
+		Help: "The number of grid cells waiting in the write buffer",
+	})
+	gridCellBufferFlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ttnmapper_gridcell_buffer_flush_duration",
+		Help:    "How long it takes to write the buffered grid cells to the database",
+		Buckets: []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 1.5, 2, 5, 10, 100, 1000, 10000},
+	})
+
 	// Other global vars
 	db *gorm.DB
 )
@@ -101,6 +273,10 @@ func main() {
 
 	reprocess := flag.Bool("reprocess", false, "Reprocess all or specific gateways")
 	offset := flag.Int("offset", 0, "Skip this number of gateways when reprocessing all")
+	rebuildDevice := flag.Bool("rebuild-device", false, "Rebuild all antennas that heard the devices with the given DevEUIs or app_id/dev_id, after blocking them")
+	reprocessExperiment := flag.Bool("reprocess-experiment", false, "Rebuild the grid cells of the experiments with the given names")
+	replayDeadLetter := flag.Bool("replay-dead-letter", false, "Publish all messages on the dead letter queue back to their original exchange")
+	migrate := flag.Bool("migrate", false, "Update the tables this service maintains, then exit")
 	flag.Parse()
 	reprocess_gateways := flag.Args()
 
@@ -111,6 +287,33 @@ func main() {
 
 	log.Printf("[Configuration]\n%s\n", prettyPrint(myConfiguration)) // output: [UserA, UserB]
 
+	if err := validateBucketSchema(); err != nil {
+		log.Fatalln("Invalid bucket schema - " + err.Error())
+	}
+	if err := validatePeriodGranularity(); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := validateSmearMode(); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := validateGridCellBuffer(); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := validateDeadLetter(); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := validateGridCellZoomLevels(); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := validateAggregationBackend(); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err := validateFrequencyBands(); err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	configureCaches()
+
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
 		err := http.ListenAndServe("0.0.0.0:"+myConfiguration.PrometheusPort, nil)
@@ -134,18 +337,40 @@ func main() {
 		panic(err.Error())
 	}
 
-	// Create tables if they do not exist
-	//log.Println("Performing auto migrate")
-	//if err := db.AutoMigrate(
-	//	// TODO: add the tables this service is responsible for maintaining
-	//	//&types.Gateway{},
-	//	&types.GridCell{},
-	//); err != nil {
-	//	log.Println("Unable autoMigrateDB - " + err.Error())
-	//}
+	// Update the tables this service is responsible for maintaining
+	if *migrate {
+		if err := migrateDatabase(); err != nil {
+			log.Fatalln("Unable to migrate database - " + err.Error())
+		}
+		return
+	}
+
+	if err := loadBucketSchema(); err != nil {
+		log.Fatalln("Unable to load bucket schema - " + err.Error())
+	}
+
+	if *replayDeadLetter {
+		log.Println("Replaying dead letter queue")
+		if err := ReplayDeadLetterQueue(); err != nil {
+			log.Fatalln(err.Error())
+		}
+		return
+	}
+
+	go handleSignals()
 
 	// Should we reprocess or listen for live data?
-	if *reprocess {
+	if *rebuildDevice {
+		log.Println("Rebuilding devices")
+		if err := RebuildDevices(flag.Args()); err != nil {
+			log.Println(err.Error())
+		}
+
+	} else if *reprocessExperiment {
+		log.Println("Reprocessing experiments")
+		ReprocessExperiments(flag.Args())
+
+	} else if *reprocess {
 		log.Println("Reprocessing")
 
 		if len(reprocess_gateways) > 0 {
@@ -157,18 +382,49 @@ func main() {
 	} else {
 		// Start amqp listener threads
 		log.Println("Starting AMQP thread")
+		amqpSubscribers.Add(2)
 		go subscribeToRabbitNewData()
 		go subscribeToRabbitMovedGateway()
 
 		// Starting processing threads
-		go processNewData()
-		go processMovedGateway()
+		var processors sync.WaitGroup
+		processors.Add(2)
+		go func() {
+			processNewData()
+			processors.Done()
+		}()
+		go func() {
+			processMovedGateway()
+			processors.Done()
+		}()
+		if gridCellBufferEnabled() {
+			go gridCellWriteBuffer.Run()
+		}
+		if periodGridCellsEnabled() && myConfiguration.PeriodRetentionDays > 0 {
+			go runPeriodRetention()
+		}
 
 		log.Printf("Init Complete")
-		forever := make(chan bool)
-		<-forever
+		<-stopping
+
+		// The subscribers stop consuming and close the processing channels, after which the processors finish
+		// their current message
+		processors.Wait()
+
+		// Do not lose the buffered grid cells
+		if err := gridCellWriteBuffer.Flush(); err != nil {
+			log.Println(err.Error())
+		}
+
+		// All acks are sent, so the AMQP connections can be closed now
+		close(amqpDrained)
+		amqpSubscribers.Wait()
+		closeDeadLetter()
 	}
 
+	closeDatabase()
+	log.Println("Shutdown complete")
+
 }
 
 func ReprocessAll(offset int) {
@@ -182,11 +438,17 @@ func ReprocessAll(offset int) {
 		if i < offset {
 			continue
 		}
+		if isStopping() {
+			log.Println("Stopped reprocessing at offset", i)
+			return
+		}
 		//if gateway.ID > 10000 {
 		//	break
 		//}
 		log.Println(i, "/", len(gateways), " ", gateway.NetworkId, " - ", gateway.GatewayId)
-		ReprocessSingleGateway(gateway)
+		if err := ReprocessSingleGateway(gateway); err != nil {
+			log.Println(err.Error())
+		}
 	}
 }
 
@@ -197,13 +459,18 @@ func ReprocessGateways(gateways []string) {
 		db.Where("gateway_id = ?", gatewayId).Find(&gateways)
 
 		for i, gateway := range gateways {
+			if isStopping() {
+				return
+			}
 			log.Println(i, "/", len(gateways), " ", gateway.NetworkId, " - ", gateway.GatewayId)
-			ReprocessSingleGateway(gateway)
+			if err := ReprocessSingleGateway(gateway); err != nil {
+				log.Println(err.Error())
+			}
 		}
 	}
 }
 
-func ReprocessSingleGateway(gateway types.Gateway) {
+func ReprocessSingleGateway(gateway types.Gateway) error {
 	/*
 		Find all antennas with same network and gateway id
 	*/
@@ -211,16 +478,23 @@ func ReprocessSingleGateway(gateway types.Gateway) {
 	db.Where("network_id = ? and gateway_id = ?", gateway.NetworkId, gateway.GatewayId).Find(&antennas)
 
 	for _, antenna := range antennas {
-		var movedTime time.Time
-		lastMovedQuery := `
+		if err := ReprocessAntenna(antenna, antennaInstalledAt(antenna)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// antennaInstalledAt returns when the gateway of the antenna last moved, from which uplinks it did not hear are counted
+func antennaInstalledAt(antenna types.Antenna) time.Time {
+	var movedTime time.Time
+	lastMovedQuery := `
 SELECT max(installed_at) FROM gateway_locations
 WHERE network_id = ?
 AND gateway_id = ?`
-		timeRow := db.Raw(lastMovedQuery, antenna.NetworkId, antenna.GatewayId).Row()
-		timeRow.Scan(&movedTime)
-
-		log.Println("Last move", movedTime)
+	timeRow := db.Raw(lastMovedQuery, antenna.NetworkId, antenna.GatewayId).Row()
+	timeRow.Scan(&movedTime)
 
-		ReprocessAntenna(antenna, movedTime)
-	}
+	log.Println("Last move", movedTime)
+	return movedTime
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// migrateDatabase brings the tables this service maintains up to date. Every step is idempotent, so it is safe to
+// run again after an update.
+func migrateDatabase() error {
+	log.Println("Performing database migrations")
+
+	// Grid cells exist for multiple zoom levels. Cells created before this were all z19. They can also be split by
+	// data rate and frequency band, where cells created before this count all packets.
+	statements := []string{
+		`ALTER TABLE grid_cells ADD COLUMN IF NOT EXISTS z smallint NOT NULL DEFAULT 19`,
+		`ALTER TABLE grid_cells ADD COLUMN IF NOT EXISTS data_rate_id bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE grid_cells ADD COLUMN IF NOT EXISTS frequency_band text NOT NULL DEFAULT ''`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	if err := createGridCellDimensionsIndex(); err != nil {
+		return err
+	}
+	statements = []string{
+		`DROP INDEX IF EXISTS idx_grid_cell`,
+		`DROP INDEX IF EXISTS idx_grid_cell_z`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	// Cells record the bucket schema they were counted with. Cells created before this used the legacy schema.
+	if err := db.AutoMigrate(&types.BucketSchema{}); err != nil {
+		return err
+	}
+	// Replaced by the index including the decay half life and smear mode
+	for _, index := range []string{"idx_bucket_schema", "idx_bucket_schema_decay"} {
+		if err := db.Exec(`DROP INDEX IF EXISTS ` + index).Error; err != nil {
+			return err
+		}
+	}
+	legacy, err := findOrCreateBucketSchema(signalMetricRssiSnr, legacyBucketEdges, 0, "")
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"grid_cells", "h3_cells"} {
+		statement := "ALTER TABLE IF EXISTS " + table + " ADD COLUMN IF NOT EXISTS bucket_schema_id bigint NOT NULL DEFAULT " + strconv.FormatUint(uint64(legacy.ID), 10)
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	// Signal statistics and decayed weights of the cells. Cells created before this only get statistics for packets
+	// added later, and are not updated with weights until rebuilt, as their bucket schema differs.
+	statisticColumns := []string{
+		"first_seen timestamp with time zone",
+		"signal_count bigint NOT NULL DEFAULT 0",
+		"rssi_sum double precision NOT NULL DEFAULT 0",
+		"rssi_sum_squares double precision NOT NULL DEFAULT 0",
+		"rssi_min real",
+		"rssi_max real",
+		"snr_sum double precision NOT NULL DEFAULT 0",
+		"snr_sum_squares double precision NOT NULL DEFAULT 0",
+		"snr_min real",
+		"snr_max real",
+		// Decayed weights
+		"weight_high double precision NOT NULL DEFAULT 0",
+		"weight100 double precision NOT NULL DEFAULT 0",
+		"weight105 double precision NOT NULL DEFAULT 0",
+		"weight110 double precision NOT NULL DEFAULT 0",
+		"weight115 double precision NOT NULL DEFAULT 0",
+		"weight120 double precision NOT NULL DEFAULT 0",
+		"weight125 double precision NOT NULL DEFAULT 0",
+		"weight130 double precision NOT NULL DEFAULT 0",
+		"weight135 double precision NOT NULL DEFAULT 0",
+		"weight140 double precision NOT NULL DEFAULT 0",
+		"weight145 double precision NOT NULL DEFAULT 0",
+		"weight_low double precision NOT NULL DEFAULT 0",
+		"weight_no_signal double precision NOT NULL DEFAULT 0",
+	}
+	for _, table := range []string{"grid_cells", "h3_cells", "period_grid_cells"} {
+		for _, column := range statisticColumns {
+			if err := db.Exec("ALTER TABLE IF EXISTS " + table + " ADD COLUMN IF NOT EXISTS " + column).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	// Operators add range overrides for single gateways, and block devices
+	if err := db.AutoMigrate(&types.GatewayRangeOverride{}, &types.BlockedDevice{}); err != nil {
+		return err
+	}
+
+	if periodGridCellsEnabled() {
+		if err := db.AutoMigrate(&types.PeriodGridCell{}); err != nil {
+			return err
+		}
+	}
+
+	if experimentGridCellsEnabled() {
+		if err := db.AutoMigrate(&types.ExperimentGridCell{}); err != nil {
+			return err
+		}
+	}
+
+	// H3 cells are resolved by the h3 extension, and stored in their own table
+	if h3AggregationEnabled() {
+		if err := db.Exec(`CREATE EXTENSION IF NOT EXISTS h3`).Error; err != nil {
+			return err
+		}
+		statements := []string{
+			`ALTER TABLE IF EXISTS h3_cells ADD COLUMN IF NOT EXISTS data_rate_id bigint NOT NULL DEFAULT 0`,
+			`ALTER TABLE IF EXISTS h3_cells ADD COLUMN IF NOT EXISTS frequency_band text NOT NULL DEFAULT ''`,
+		}
+		for _, statement := range statements {
+			if err := db.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		if err := db.AutoMigrate(&types.H3Cell{}); err != nil {
+			return err
+		}
+		// Replaced by the index including the dimensions
+		if err := db.Exec(`DROP INDEX IF EXISTS idx_h3_cell`).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createGridCellDimensionsIndex builds the unique index on the grid cell key without blocking writes, as grid_cells is
+// large and written to by the other instances while this one starts. A concurrent build can not run in a transaction,
+// and leaves an invalid index behind when it fails, which is dropped so that the next start builds it again.
+func createGridCellDimensionsIndex() error {
+	var invalid int64
+	invalidQuery := `
+SELECT count(*) FROM pg_index
+JOIN pg_class ON pg_class.oid = pg_index.indexrelid
+WHERE pg_class.relname = 'idx_grid_cell_dimensions'
+AND NOT pg_index.indisvalid`
+	if err := db.Raw(invalidQuery).Scan(&invalid).Error; err != nil {
+		return err
+	}
+	if invalid > 0 {
+		log.Println("Dropping invalid index idx_grid_cell_dimensions")
+		if err := db.Exec(`DROP INDEX CONCURRENTLY IF EXISTS idx_grid_cell_dimensions`).Error; err != nil {
+			return err
+		}
+	}
+
+	return db.Exec(`CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS idx_grid_cell_dimensions ON grid_cells (antenna_id, x, y, z, data_rate_id, frequency_band)`).Error
+}
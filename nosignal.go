@@ -0,0 +1,238 @@
+package main
+
+import (
+	"gorm.io/gorm"
+	"log"
+	"math"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// An uplink that was mapped near an antenna, but not heard by it, is evidence that the antenna has no coverage at
+// that location. These are counted in the no signal bucket of the antenna's cells.
+
+// Slightly less than the real distance, so that rounding never makes a bounding box too small
+const kmPerDegreeLatitude = 111.0
+
+// boundingBox returns the coordinate ranges containing every point within km of the given point. It may contain
+// more, which needs to be filtered out with an exact distance check.
+func boundingBox(latitude float64, longitude float64, km float64) (minLatitude, maxLatitude, minLongitude, maxLongitude float64) {
+	deltaLatitude := km / kmPerDegreeLatitude
+	minLatitude = math.Max(latitude-deltaLatitude, -90)
+	maxLatitude = math.Min(latitude+deltaLatitude, 90)
+
+	// Degrees of longitude are shortest at the edge of the box furthest from the equator
+	cos := math.Cos(math.Max(math.Abs(minLatitude), math.Abs(maxLatitude)) * math.Pi / 180)
+	if cos < 0.001 {
+		return minLatitude, maxLatitude, -180, 180
+	}
+	deltaLongitude := km / (kmPerDegreeLatitude * cos)
+	minLongitude = longitude - deltaLongitude
+	maxLongitude = longitude + deltaLongitude
+	if minLongitude < -180 || maxLongitude > 180 {
+		// Crossing the antimeridian is rare enough to simply search all longitudes
+		return minLatitude, maxLatitude, -180, 180
+	}
+	return minLatitude, maxLatitude, minLongitude, maxLongitude
+}
+
+// noSignalAntennas returns the known antennas near a live uplink that did not hear it. Only networks that heard the
+// uplink are searched, as we can not know whether the device was registered on other networks. The search uses the
+// current gateway locations, so the candidates still need a distance check against the location at the time of the
+// uplink.
+func noSignalAntennas(message types.TtnMapperUplinkMessage) ([]types.Antenna, error) {
+	var networks []string
+	heard := map[types.AntennaIndexer]bool{}
+	for _, gateway := range message.Gateways {
+		indexer := types.AntennaIndexer{NetworkId: gateway.NetworkId, GatewayId: gateway.GatewayId, AntennaIndex: gateway.AntennaIndex}
+		heard[indexer] = true
+
+		known := false
+		for _, network := range networks {
+			if network == gateway.NetworkId {
+				known = true
+				break
+			}
+		}
+		if !known {
+			networks = append(networks, gateway.NetworkId)
+		}
+	}
+
+	rangeKm, err := networksMaximumRangeKm(networks)
+	if err != nil {
+		return nil, err
+	}
+	minLatitude, maxLatitude, minLongitude, maxLongitude := boundingBox(message.Latitude, message.Longitude, rangeKm)
+
+	var candidates []types.Antenna
+	err = db.Select("antennas.*").
+		Joins("JOIN gateways ON gateways.network_id = antennas.network_id AND gateways.gateway_id = antennas.gateway_id").
+		Where("antennas.network_id IN ?", networks).
+		Where("gateways.latitude BETWEEN ? AND ?", minLatitude, maxLatitude).
+		Where("gateways.longitude BETWEEN ? AND ?", minLongitude, maxLongitude).
+		Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	antennas := make([]types.Antenna, 0, len(candidates))
+	for _, antenna := range candidates {
+		indexer := types.AntennaIndexer{NetworkId: antenna.NetworkId, GatewayId: antenna.GatewayId, AntennaIndex: antenna.AntennaIndex}
+		if !heard[indexer] {
+			antennas = append(antennas, antenna)
+		}
+	}
+	return antennas, nil
+}
+
+// aggregateNoSignal counts a live uplink in the no signal bucket of an antenna that did not hear it. The counts are
+// kept apart in cells until it is known whether a gateway that heard the uplink accepted its location.
+func aggregateNoSignal(message types.TtnMapperUplinkMessage, antenna types.Antenna, cells *liveCells) error {
+	gateway := types.TtnMapperGateway{NetworkId: antenna.NetworkId, GatewayId: antenna.GatewayId, AntennaIndex: antenna.AntennaIndex}
+	if !CheckDistanceFromGateway(gateway, message) {
+		return nil
+	}
+
+	entryTime := uplinkTime(message)
+	err := aggregateLiveCells(antenna.ID, message, func(buckets *types.SignalBuckets) {
+		incrementNoSignal(buckets, entryTime)
+	}, cells.noSignal)
+	if err != nil {
+		return err
+	}
+
+	cells.mutex.Lock()
+	cells.noSignalAntennas++
+	cells.mutex.Unlock()
+	return nil
+}
+
+// reprocessNoSignal adds the uplinks near an antenna since the given time that the antenna did not hear to its cells.
+// Uplinks are identified by their device, frame counter and time, as every gateway that heard one has its own
+// packet row. Like live, an uplink only counts if one of the antennas that heard it accepted its location.
+func reprocessNoSignal(tx *gorm.DB, antenna types.Antenna, since time.Time, cells *antennaCells) error {
+	gatewayIndexer := types.GatewayIndexer{NetworkId: antenna.NetworkId, GatewayId: antenna.GatewayId}
+	latitude, longitude, err := gatewayLocation(gatewayIndexer, time.Now())
+	if err != nil {
+		return err
+	}
+	if latitude == 0 && longitude == 0 {
+		// Unknown location or blacklisted, so nothing is near it
+		return nil
+	}
+
+	rangeKm, err := gatewayMaximumRangeKm(gatewayIndexer)
+	if err != nil {
+		return err
+	}
+	minLatitude, maxLatitude, minLongitude, maxLongitude := boundingBox(latitude, longitude, rangeKm)
+
+	// All packets of the uplinks, ordered so that the packets of one uplink are consecutive
+	noSignalQuery := `
+SELECT packets.*
+FROM packets
+JOIN antennas ON antennas.id = packets.antenna_id
+WHERE antennas.network_id = ?
+AND packets.time > ?
+AND packets.experiment_id IS NULL
+AND packets.latitude BETWEEN ? AND ?
+AND packets.longitude BETWEEN ? AND ?
+AND NOT EXISTS (
+	SELECT 1 FROM packets heard
+	WHERE heard.antenna_id = ?
+	AND heard.device_id = packets.device_id
+	AND heard.f_cnt = packets.f_cnt
+	AND heard.time = packets.time
+)
+ORDER BY packets.device_id, packets.f_cnt, packets.time`
+	rows, err := tx.Raw(noSignalQuery, antenna.NetworkId, since, minLatitude, maxLatitude, minLongitude, maxLongitude, antenna.ID).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	receivers := map[uint]types.Antenna{}
+	var uplink types.Packet
+	candidate := false // the uplink is near the antenna, and its location is good enough
+	accepted := false  // an antenna that heard the uplink accepted its location
+	count := 0
+
+	addUplink := func() error {
+		if !candidate || !accepted {
+			return nil
+		}
+		count++
+		return cells.Add(uplink, true)
+	}
+
+	for rows.Next() {
+		if isStopping() {
+			return errShuttingDown
+		}
+
+		var packet types.Packet
+		if err := tx.ScanRows(rows, &packet); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		if packet.DeviceID != uplink.DeviceID || packet.FCnt != uplink.FCnt || !packet.Time.Equal(uplink.Time) {
+			if err := addUplink(); err != nil {
+				return err
+			}
+			uplink = packet
+			accepted = false
+			candidate, err = noSignalCandidate(antenna, packet)
+			if err != nil {
+				return err
+			}
+		}
+
+		if candidate && !accepted {
+			accepted, err = acceptedByReceiver(receivers, packet)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := addUplink(); err != nil {
+		return err
+	}
+
+	log.Printf("Found %d uplinks not heard by the antenna", count)
+	noSignalUplinks.Add(float64(count))
+	return nil
+}
+
+// noSignalCandidate reports whether an uplink the antenna did not hear could count as no signal for it
+func noSignalCandidate(antenna types.Antenna, packet types.Packet) (bool, error) {
+	accept, err := acceptPacketLocationQuality(packet)
+	if err != nil || !accept {
+		return false, err
+	}
+	blocked, err := packetDeviceBlocked(packet)
+	if err != nil || blocked {
+		return false, err
+	}
+	return CheckDistanceFromAntenna(antenna, packet), nil
+}
+
+// acceptedByReceiver reports whether the antenna that received the packet counts it, using the same checks as
+// ReprocessAntenna. Antennas are looked up once and kept in receivers.
+func acceptedByReceiver(receivers map[uint]types.Antenna, packet types.Packet) (bool, error) {
+	receiver, ok := receivers[packet.AntennaID]
+	if !ok {
+		if err := db.First(&receiver, packet.AntennaID).Error; err != nil {
+			return false, err
+		}
+		receivers[packet.AntennaID] = receiver
+	}
+	if !CheckDistanceFromAntenna(receiver, packet) {
+		return false, nil
+	}
+	return CheckPathLossFromAntenna(receiver, packet)
+}
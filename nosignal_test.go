@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/umahmood/haversine"
+	"testing"
+)
+
+func TestBoundingBox(t *testing.T) {
+	center := haversine.Coord{Lat: 60, Lon: 10}
+	km := 100.0
+	minLatitude, maxLatitude, minLongitude, maxLongitude := boundingBox(center.Lat, center.Lon, km)
+
+	// Every edge of the box must be at least the range away, also at the corner furthest from the equator
+	edges := []haversine.Coord{
+		{Lat: minLatitude, Lon: center.Lon},
+		{Lat: maxLatitude, Lon: center.Lon},
+		{Lat: maxLatitude, Lon: minLongitude},
+		{Lat: maxLatitude, Lon: maxLongitude},
+		{Lat: center.Lat, Lon: minLongitude},
+	}
+	for _, edge := range edges {
+		if _, distance := haversine.Distance(center, edge); distance < km*0.999 {
+			t.Fatalf("edge %v is only %f km away", edge, distance)
+		}
+	}
+
+	_, _, minLongitude, maxLongitude = boundingBox(0, 179.9, km)
+	if minLongitude != -180 || maxLongitude != 180 {
+		t.Fatalf("box crossing the antimeridian should span all longitudes, got %f to %f", minLongitude, maxLongitude)
+	}
+}
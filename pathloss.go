@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// A GPS glitch can put a point far away from where the device was, while the gateway still heard it strongly. The
+// path loss over the distance to the gateway limits how strong the signal can be, so points received stronger than
+// that are left out.
+
+// Used when the frequency is unknown. The lowest LoRaWAN band has the least path loss, so the longest range.
+const pathLossDefaultHerz = 433e6
+
+// pathLossDb returns the expected path loss over the distance at the frequency, following the log-distance model
+// from the free space loss at 1 km
+func pathLossDb(km float64, herz float64) float64 {
+	freeSpaceAt1Km := 20*math.Log10(1000) + 20*math.Log10(herz) - 147.55
+	return freeSpaceAt1Km + 10*myConfiguration.PathLossExponent*math.Log10(km)
+}
+
+// plausibleSignal is whether a signal received with rssi could have travelled the distance. An rssi of 0 is not
+// reported, so is always plausible.
+func plausibleSignal(km float64, rssi float32, herz uint64) bool {
+	if rssi == 0 {
+		return true
+	}
+	if herz == 0 {
+		herz = pathLossDefaultHerz
+	}
+	maximumLossDb := myConfiguration.PathLossMaxEirpDbm + myConfiguration.PathLossMarginDb - float64(rssi)
+	return pathLossDb(km, float64(herz)) <= maximumLossDb
+}
+
+// CheckPathLossFromGateway is whether the gateway could have heard the live uplink as strong as it did, counting the
+// uplink if it could not
+func CheckPathLossFromGateway(gateway types.TtnMapperGateway, message types.TtnMapperUplinkMessage) bool {
+	if !myConfiguration.PathLossFilterEnabled {
+		return true
+	}
+
+	km, ok := gatewayDistanceKm(gateway, message)
+	if !ok {
+		return false
+	}
+	if !plausibleSignal(km, gateway.Rssi, message.Frequency) {
+		rejectedPoints.WithLabelValues(rejectPathLoss).Inc()
+		return false
+	}
+	return true
+}
+
+// CheckPathLossFromAntenna is CheckPathLossFromGateway for a stored packet
+func CheckPathLossFromAntenna(antenna types.Antenna, packet types.Packet) (bool, error) {
+	if !myConfiguration.PathLossFilterEnabled {
+		return true, nil
+	}
+
+	var herz uint64
+	if packet.FrequencyID != 0 {
+		var err error
+		herz, err = getFrequencyHerz(packet.FrequencyID)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	gateway := types.TtnMapperGateway{NetworkId: antenna.NetworkId, GatewayId: antenna.GatewayId, Rssi: packet.Rssi}
+	message := types.TtnMapperUplinkMessage{Latitude: packet.Latitude, Longitude: packet.Longitude, Time: packet.Time.UnixNano(), Frequency: herz}
+	return CheckPathLossFromGateway(gateway, message), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestPlausibleSignal(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	myConfiguration.PathLossMaxEirpDbm = 30
+	myConfiguration.PathLossExponent = 2
+	myConfiguration.PathLossMarginDb = 10
+
+	tests := []struct {
+		km   float64
+		rssi float32
+		herz uint64
+		want bool
+	}{
+		{1, -70, 868100000, true},
+		{150, -120, 868100000, true},
+		{150, -40, 868100000, false}, // a GPS glitch far from a gateway that heard it strongly
+		{150, -40, 0, false},
+		{150, 0, 868100000, true},
+	}
+	for _, test := range tests {
+		if got := plausibleSignal(test.km, test.rssi, test.herz); got != test.want {
+			t.Errorf("%f km at %f dBm: got %v, want %v", test.km, test.rssi, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"gorm.io/gorm/clause"
+	"log"
+	"sort"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// Granularities of the period grid cells
+const (
+	periodDay   = "day"
+	periodWeek  = "week"
+	periodMonth = "month"
+)
+
+// How often periods older than the retention are deleted
+const periodRetentionInterval = time.Hour
+
+// Period grid cells are identified by these columns, which have a unique index on them
+var periodGridCellTable = cellTable{"period_grid_cells", []clause.Column{{Name: "antenna_id"}, {Name: "x"}, {Name: "y"}, {Name: "z"}, {Name: "period_start"}}}
+
+func periodGridCellsEnabled() bool {
+	return myConfiguration.PeriodGranularity != "" && tileAggregationEnabled()
+}
+
+func validatePeriodGranularity() error {
+	switch myConfiguration.PeriodGranularity {
+	case "", periodDay, periodWeek, periodMonth:
+		return nil
+	default:
+		return errors.New("unknown period granularity " + myConfiguration.PeriodGranularity)
+	}
+}
+
+// periodStart returns the start of the period containing t, in UTC. Weeks start on Monday.
+func periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	switch myConfiguration.PeriodGranularity {
+	case periodDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case periodWeek:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// periodRetentionStart returns the start of the oldest period that is kept, or the zero time if all are kept
+func periodRetentionStart() time.Time {
+	if myConfiguration.PeriodRetentionDays <= 0 {
+		return time.Time{}
+	}
+	return periodStart(time.Now().AddDate(0, 0, -myConfiguration.PeriodRetentionDays))
+}
+
+// addPeriodGridCells adds the counts of the grid cells that count all packets to the period grid cells of the period
+// containing the packet time. Packets in periods that are no longer kept are ignored.
+func addPeriodGridCells(periodGridCells periodGridCellMap, gridCells []types.GridCell, at time.Time) {
+	start := periodStart(at)
+	if start.Before(periodRetentionStart()) {
+		return
+	}
+
+	for _, gridCell := range gridCells {
+		if gridCell.DataRateID != 0 || gridCell.FrequencyBand != "" {
+			continue
+		}
+		periodGridCells.add(types.PeriodGridCell{
+			AntennaID:      gridCell.AntennaID,
+			X:              gridCell.X,
+			Y:              gridCell.Y,
+			Z:              gridCell.Z,
+			PeriodStart:    start,
+			BucketSchemaID: gridCell.BucketSchemaID,
+			SignalBuckets:  gridCell.SignalBuckets,
+		})
+	}
+}
+
+func periodGridCellIndex(periodGridCell types.PeriodGridCell) types.PeriodGridCellIndexer {
+	return types.PeriodGridCellIndexer{
+		AntennaId:   periodGridCell.AntennaID,
+		X:           periodGridCell.X,
+		Y:           periodGridCell.Y,
+		Z:           periodGridCell.Z,
+		PeriodStart: periodGridCell.PeriodStart,
+	}
+}
+
+type periodGridCellMap map[types.PeriodGridCellIndexer]types.PeriodGridCell
+
+// add sums the counts of periodGridCell into the cell with the same index
+func (m periodGridCellMap) add(periodGridCell types.PeriodGridCell) {
+	periodGridCellIndexer := periodGridCellIndex(periodGridCell)
+	existing, ok := m[periodGridCellIndexer]
+	if ok {
+		addSignalBuckets(&existing.SignalBuckets, periodGridCell.SignalBuckets)
+		m[periodGridCellIndexer] = existing
+	} else {
+		m[periodGridCellIndexer] = periodGridCell
+	}
+}
+
+func (m periodGridCellMap) table() cellTable { return periodGridCellTable }
+func (m periodGridCellMap) size() int        { return len(m) }
+
+func (m periodGridCellMap) sorted() interface{} {
+	periodGridCells := make([]types.PeriodGridCell, 0, len(m))
+	for _, periodGridCell := range m {
+		periodGridCells = append(periodGridCells, periodGridCell)
+	}
+
+	sort.Slice(periodGridCells, func(i, j int) bool {
+		a, b := periodGridCells[i], periodGridCells[j]
+		if a.AntennaID != b.AntennaID {
+			return a.AntennaID < b.AntennaID
+		}
+		if !a.PeriodStart.Equal(b.PeriodStart) {
+			return a.PeriodStart.Before(b.PeriodStart)
+		}
+		if a.Z != b.Z {
+			return a.Z < b.Z
+		}
+		if a.X != b.X {
+			return a.X < b.X
+		}
+		return a.Y < b.Y
+	})
+	return &periodGridCells
+}
+
+// runPeriodRetention regularly deletes the period grid cells older than the retention
+func runPeriodRetention() {
+	ticker := time.NewTicker(periodRetentionInterval)
+	defer ticker.Stop()
+
+	for {
+		retentionStart := periodRetentionStart()
+		result := db.Where("period_start < ?", retentionStart).Delete(&types.PeriodGridCell{})
+		if result.Error != nil {
+			log.Println("Failed to delete expired period grid cells:", result.Error.Error())
+		} else if result.RowsAffected > 0 {
+			log.Printf("Deleted %d period grid cells before %s", result.RowsAffected, retentionStart.Format("2006-01-02"))
+			deletedGridCells.Add(float64(result.RowsAffected))
+		}
+
+		select {
+		case <-stopping:
+			return
+		case <-ticker.C:
+		}
+	}
+}
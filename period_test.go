@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	defer func(granularity string) { myConfiguration.PeriodGranularity = granularity }(myConfiguration.PeriodGranularity)
+
+	// A Wednesday evening, which is already Thursday in UTC
+	at := time.Date(2021, 3, 17, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60))
+
+	tests := map[string]time.Time{
+		periodDay:   time.Date(2021, 3, 18, 0, 0, 0, 0, time.UTC),
+		periodWeek:  time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC),
+		periodMonth: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for granularity, want := range tests {
+		myConfiguration.PeriodGranularity = granularity
+		if got := periodStart(at); !got.Equal(want) {
+			t.Errorf("%s: got %s, want %s", granularity, got, want)
+		}
+	}
+
+	// Weeks start on Monday, also when the week started in the previous month
+	myConfiguration.PeriodGranularity = periodWeek
+	sunday := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	if got := periodStart(sunday); !got.Equal(time.Date(2021, 7, 26, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %s for a sunday", got)
+	}
+}
@@ -2,34 +2,179 @@ package main
 
 import (
 	"encoding/json"
+	"github.com/streadway/amqp"
+	"hash/fnv"
+	"log"
+	"sync"
 	"ttnmapper-postgres-insert-gridcell/types"
 )
 
+// liveJob is one gateway of a live uplink, handled by the worker for that gateway's antenna
+type liveJob struct {
+	message types.TtnMapperUplinkMessage
+	gateway types.TtnMapperGateway
+	result  *liveResult
+	cells   *liveCells // collects the increments of all jobs of the uplink
+
+	// Set when the job is for a nearby antenna that did not hear the uplink, instead of a gateway that did
+	noSignalAntenna *types.Antenna
+}
+
+// liveResult collects the outcome of all gateways of one uplink, which can be handled by different workers
+type liveResult struct {
+	mutex     sync.Mutex
+	remaining int
+	err       error
+	done      func(error)
+}
+
+func (r *liveResult) finish(err error) {
+	r.mutex.Lock()
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	r.remaining--
+	last := r.remaining == 0
+	r.mutex.Unlock()
+
+	if last {
+		r.done(r.err)
+	}
+}
+
 // A new live packet came in. Add it to the appropriate gridcell.
+// Gateways are handed to a pool of workers, sharded by antenna, so that all updates to the same grid cell are done
+// by the same worker in the order they arrived.
 func processNewData() {
+	workerCount := myConfiguration.LiveWorkers
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	var workers sync.WaitGroup
+	workerChannels := make([]chan liveJob, workerCount)
+	for i := range workerChannels {
+		workerChannels[i] = make(chan liveJob)
+		workers.Add(1)
+		go func(jobs chan liveJob) {
+			for job := range jobs {
+				if job.noSignalAntenna != nil {
+					job.result.finish(aggregateNoSignal(job.message, *job.noSignalAntenna, job.cells))
+				} else if job.message.Experiment != "" {
+					job.result.finish(aggregateExperimentGateway(job.message, job.gateway, job.cells))
+				} else {
+					job.result.finish(aggregateGateway(job.message, job.gateway, job.cells))
+				}
+			}
+			workers.Done()
+		}(workerChannels[i])
+	}
+
 	for data := range newDataChannel {
 		var message types.TtnMapperUplinkMessage
 		if err := json.Unmarshal(data.Body, &message); err != nil {
+			log.Println(err.Error())
+			settleDelivery(data, failureStageDecode, err)
 			continue
 		}
 
-		// This aggregation does not use experiment data
-		if message.Experiment != "" {
+		processedLive.Inc()
+
+		if !acceptNewData(message) || len(message.Gateways) == 0 {
+			settleDelivery(data, "", nil)
 			continue
 		}
 
-		aggregateNewData(message)
+		blocked, err := messageDeviceBlocked(message)
+		if err != nil {
+			log.Println(err.Error())
+			settleDelivery(data, failureStageAggregate, err)
+			continue
+		}
+		if blocked {
+			settleDelivery(data, "", nil)
+			continue
+		}
+
+		var noSignal []types.Antenna
+		// Experiments only count the gateways that heard them
+		if myConfiguration.NoSignalEnabled && message.Experiment == "" {
+			noSignal, err = noSignalAntennas(message)
+			if err != nil {
+				log.Println(err.Error())
+				settleDelivery(data, failureStageAggregate, err)
+				continue
+			}
+		}
+
+		cells := newLiveCells()
+		result := &liveResult{remaining: len(message.Gateways) + len(noSignal), done: settleLiveDelivery(data, cells)}
+		for _, gateway := range message.Gateways {
+			workerChannels[liveWorkerIndex(gateway, workerCount)] <- liveJob{message: message, gateway: gateway, result: result, cells: cells}
+		}
+		for i := range noSignal {
+			antenna := &noSignal[i]
+			// Shard like the gateway of the antenna, so that all updates to its cells stay on one worker
+			gateway := types.TtnMapperGateway{NetworkId: antenna.NetworkId, GatewayId: antenna.GatewayId, AntennaIndex: antenna.AntennaIndex}
+			workerChannels[liveWorkerIndex(gateway, workerCount)] <- liveJob{message: message, gateway: gateway, result: result, cells: cells, noSignalAntenna: antenna}
+		}
+	}
+
+	// Let the workers finish what they have
+	for _, jobs := range workerChannels {
+		close(jobs)
+	}
+	workers.Wait()
+}
+
+// settleLiveDelivery returns the function that stores the cells of a live delivery and settles it once all its
+// gateways are handled. Nothing is stored if one of them failed, so that the retry counts every gateway once.
+func settleLiveDelivery(data amqp.Delivery, cells *liveCells) func(error) {
+	return func(err error) {
+		if err != nil {
+			settleDelivery(data, failureStageAggregate, err)
+			return
+		}
+
+		cells.addNoSignal()
+
+		if gridCellBufferEnabled() {
+			// Only settle once the buffered grid cells are in the database
+			gridCellWriteBuffer.AddLive(cells, func(err error) {
+				settleDelivery(data, failureStageAggregate, err)
+			})
+			return
+		}
+
+		err = db.Transaction(cells.Increment)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		settleDelivery(data, failureStageAggregate, err)
 	}
 }
 
+// liveWorkerIndex picks the worker for a gateway based on its antenna
+func liveWorkerIndex(gateway types.TtnMapperGateway, workerCount int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(gateway.NetworkId))
+	hash.Write([]byte{0})
+	hash.Write([]byte(gateway.GatewayId))
+	hash.Write([]byte{0, gateway.AntennaIndex})
+	return int(hash.Sum32() % uint32(workerCount))
+}
+
 // If a gateway moved, delete and rebuild all its gridcells
 func processMovedGateway() {
 	for data := range gatewayMovedChannel {
 		var message types.TtnMapperGatewayMoved
 		if err := json.Unmarshal(data.Body, &message); err != nil {
+			log.Println(err.Error())
+			settleDelivery(data, failureStageDecode, err)
 			continue
 		}
 
-		aggregateMovedGateway(message)
+		err := aggregateMovedGateway(message)
+		settleDelivery(data, failureStageAggregate, err)
 	}
 }
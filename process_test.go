@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"strings"
+	"testing"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+func TestLiveWorkerIndex(t *testing.T) {
+	gateway := types.TtnMapperGateway{NetworkId: "thethingsnetwork.org", GatewayId: "eui-58a0cbfffe8023e7", AntennaIndex: 1}
+
+	first := liveWorkerIndex(gateway, 8)
+	for i := 0; i < 10; i++ {
+		if index := liveWorkerIndex(gateway, 8); index != first {
+			t.Fatalf("same antenna went to worker %d and %d", first, index)
+		}
+	}
+	if first < 0 || first >= 8 {
+		t.Fatalf("worker index %d out of range", first)
+	}
+
+	if index := liveWorkerIndex(gateway, 1); index != 0 {
+		t.Fatalf("single worker got index %d", index)
+	}
+}
+
+func TestLiveResult(t *testing.T) {
+	calls := 0
+	var result error
+	r := &liveResult{remaining: 3, done: func(err error) {
+		calls++
+		result = err
+	}}
+
+	failed := errors.New("failed")
+	r.finish(nil)
+	r.finish(failed)
+	if calls != 0 {
+		t.Fatal("done called before all gateways finished")
+	}
+	r.finish(nil)
+
+	if calls != 1 {
+		t.Fatalf("done called %d times", calls)
+	}
+	if result != failed {
+		t.Fatalf("expected the first error, got %v", result)
+	}
+}
+
+func TestIncrementAssignments(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	useUnreachableDb(t)
+	myConfiguration.DecayHalfLifeDays = 0
+	myConfiguration.SmearMode = ""
+
+	// Gateways of the same uplink that share a cell are summed before the upsert
+	cells := testLiveCells(t)
+	cells.gridCells.add(testGridCell(t))
+	if len(cells.gridCells) != 1 {
+		t.Fatalf("got %d cells, want 1", len(cells.gridCells))
+	}
+
+	tx := db.Session(&gorm.Session{DryRun: true, SkipDefaultTransaction: true})
+	result := tx.Clauses(clause.OnConflict{
+		Columns:   gridCellTable.keyColumns,
+		DoUpdates: incrementAssignments(gridCellTable.name),
+		Where:     sameBucketSchema(gridCellTable.name),
+	}).Create(cells.gridCells.sorted())
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	sql := result.Statement.SQL.String()
+	for _, want := range []string{
+		`ON CONFLICT ("antenna_id","x","y","z","data_rate_id","frequency_band") DO UPDATE SET`,
+		`"bucket_high"=grid_cells.bucket_high + excluded.bucket_high`,
+		`"rssi_min"=LEAST(grid_cells.rssi_min, excluded.rssi_min)`,
+		`"last_updated"=GREATEST(grid_cells.last_updated, excluded.last_updated)`,
+		`WHERE grid_cells.bucket_schema_id = excluded.bucket_schema_id`,
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("%q not in %s", want, sql)
+		}
+	}
+}
+
+// recordingLogger keeps the SQL of every statement run through it
+type recordingLogger struct {
+	statements []string
+}
+
+func (l *recordingLogger) LogMode(logger.LogLevel) logger.Interface      { return l }
+func (l *recordingLogger) Info(context.Context, string, ...interface{})  {}
+func (l *recordingLogger) Warn(context.Context, string, ...interface{})  {}
+func (l *recordingLogger) Error(context.Context, string, ...interface{}) {}
+func (l *recordingLogger) Trace(_ context.Context, _ time.Time, fc func() (string, int64), _ error) {
+	sql, _ := fc()
+	l.statements = append(l.statements, sql)
+}
+
+func TestAntennaCellsStore(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	useUnreachableDb(t)
+	myConfiguration.AggregationBackend = aggregationBackendTile
+	myConfiguration.PeriodGranularity = ""
+	myConfiguration.DecayHalfLifeDays = 0
+	myConfiguration.SmearMode = ""
+
+	cells := newAntennaCells(types.Antenna{ID: 1})
+	cells.gridCells.add(testGridCell(t))
+
+	// The old cells are only deleted in the same transaction that stores the rebuilt ones
+	recorder := &recordingLogger{}
+	tx := db.Session(&gorm.Session{DryRun: true, SkipDefaultTransaction: true, Logger: recorder})
+	if _, err := cells.Store(tx); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.statements) != 2 {
+		t.Fatalf("got statements %v, want a delete and an insert", recorder.statements)
+	}
+	if !strings.HasPrefix(recorder.statements[0], `DELETE FROM "grid_cells" WHERE "grid_cells"."antenna_id" = 1`) {
+		t.Errorf("first statement is %s", recorder.statements[0])
+	}
+	if !strings.HasPrefix(recorder.statements[1], `INSERT INTO "grid_cells"`) {
+		t.Errorf("second statement is %s", recorder.statements[1])
+	}
+}
+
+func TestLiveCellsIncrementLocksAntennas(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	useUnreachableDb(t)
+	myConfiguration.AggregationBackend = aggregationBackendTile
+
+	// The increments wait for rebuilds of their antennas before touching any cell
+	recorder := &recordingLogger{}
+	tx := db.Session(&gorm.Session{DryRun: true, SkipDefaultTransaction: true, Logger: recorder})
+	if err := testLiveCells(t).Increment(tx); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.statements) < 2 {
+		t.Fatalf("got statements %v, want a lock and an increment", recorder.statements)
+	}
+	if !strings.Contains(recorder.statements[0], "pg_advisory_xact_lock_shared") {
+		t.Errorf("first statement is %s", recorder.statements[0])
+	}
+}
+
+func TestValidateGridCellZoomLevels(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+
+	tests := []struct {
+		backend    string
+		zoomLevels []int
+		valid      bool
+	}{
+		{aggregationBackendTile, []int{19}, true},
+		{aggregationBackendTile, []int{0, 13, 19}, true},
+		{aggregationBackendTile, []int{19, 17, 19}, false},
+		{aggregationBackendTile, []int{20}, false},
+		{aggregationBackendTile, []int{-1}, false},
+		{aggregationBackendTile, nil, false},
+		{aggregationBackendH3, nil, true},
+	}
+	for _, test := range tests {
+		myConfiguration.AggregationBackend = test.backend
+		myConfiguration.GridCellZoomLevels = test.zoomLevels
+		if err := validateGridCellZoomLevels(); (err == nil) != test.valid {
+			t.Errorf("%s %v: got %v, want valid %v", test.backend, test.zoomLevels, err, test.valid)
+		}
+	}
+}
+
+func TestLiveCellsAddNoSignal(t *testing.T) {
+	// Without a gateway that accepted the uplink, there is no evidence of missing coverage
+	cells := newLiveCells()
+	cells.noSignal.gridCells.add(testGridCell(t))
+	cells.addNoSignal()
+	if len(cells.gridCells) != 0 {
+		t.Fatalf("got %d cells from a rejected uplink", len(cells.gridCells))
+	}
+
+	cells.accepted = true
+	cells.addNoSignal()
+	if len(cells.gridCells) != 1 || len(cells.noSignal.gridCells) != 0 {
+		t.Fatalf("got %d cells and %d left, want the no signal cell added", len(cells.gridCells), len(cells.noSignal.gridCells))
+	}
+}
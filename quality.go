@@ -0,0 +1,131 @@
+package main
+
+import (
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// Points with a poor location fix would smear coverage over the wrong cells, so they can be left out. Values that
+// were not reported pass, as most devices do not report them.
+
+// Reasons a point is rejected, used as the label of rejectedPoints
+const (
+	rejectAccuracy       = "accuracy"
+	rejectHdop           = "hdop"
+	rejectSatellites     = "satellites"
+	rejectAccuracySource = "accuracy_source"
+	rejectPathLoss       = "path_loss"
+	rejectBlockedDevice  = "blocked_device"
+)
+
+var accuracySourceDbCache = accuracySourceCache{newLruCache("accuracy_source", 100, 24*time.Hour)}
+
+type accuracySourceCache struct {
+	*lruCache
+}
+
+func (c accuracySourceCache) Get(accuracySourceID uint) (string, bool) {
+	i, ok := c.lruCache.Get(accuracySourceID)
+	if !ok {
+		return "", false
+	}
+	return i.(string), true
+}
+
+func (c accuracySourceCache) Set(accuracySourceID uint, name string) {
+	c.lruCache.Set(accuracySourceID, name)
+}
+
+// locationQuality is how good the location of a point is, with nil or "" for values that were not reported
+type locationQuality struct {
+	AccuracyMeters *float64
+	Hdop           *float64
+	Satellites     *int32
+	AccuracySource string
+}
+
+// messageLocationQuality returns the location quality of a live uplink, which omits unreported values as zero
+func messageLocationQuality(message types.TtnMapperUplinkMessage) locationQuality {
+	quality := locationQuality{AccuracySource: message.AccuracySource}
+	if message.AccuracyMeters != 0 {
+		quality.AccuracyMeters = &message.AccuracyMeters
+	}
+	if message.Hdop != 0 {
+		quality.Hdop = &message.Hdop
+	}
+	if message.Satellites != 0 {
+		quality.Satellites = &message.Satellites
+	}
+	return quality
+}
+
+// packetLocationQuality returns the location quality of a stored packet
+func packetLocationQuality(packet types.Packet) (locationQuality, error) {
+	quality := locationQuality{
+		AccuracyMeters: packet.AccuracyMeters,
+		Hdop:           packet.Hdop,
+		Satellites:     packet.Satellites,
+	}
+	// The name is only needed to check it against the excluded sources
+	if len(myConfiguration.ExcludedAccuracySources) > 0 && packet.AccuracySourceID != 0 {
+		var err error
+		quality.AccuracySource, err = getAccuracySourceName(packet.AccuracySourceID)
+		if err != nil {
+			return quality, err
+		}
+	}
+	return quality, nil
+}
+
+func getAccuracySourceName(accuracySourceID uint) (string, error) {
+	name, ok := accuracySourceDbCache.Get(accuracySourceID)
+	if ok {
+		return name, nil
+	}
+
+	var accuracySourceDb types.AccuracySource
+	err := db.First(&accuracySourceDb, accuracySourceID).Error
+	if err != nil {
+		return "", err
+	}
+	accuracySourceDbCache.Set(accuracySourceID, accuracySourceDb.Name)
+	return accuracySourceDb.Name, nil
+}
+
+// locationQualityRejection returns why a point does not pass the configured quality gate, or "" if it does
+func locationQualityRejection(quality locationQuality) string {
+	if myConfiguration.MaxAccuracyMeters > 0 && quality.AccuracyMeters != nil && *quality.AccuracyMeters > myConfiguration.MaxAccuracyMeters {
+		return rejectAccuracy
+	}
+	if myConfiguration.MaxHdop > 0 && quality.Hdop != nil && *quality.Hdop > myConfiguration.MaxHdop {
+		return rejectHdop
+	}
+	if myConfiguration.MinSatellites > 0 && quality.Satellites != nil && *quality.Satellites < myConfiguration.MinSatellites {
+		return rejectSatellites
+	}
+	for _, source := range myConfiguration.ExcludedAccuracySources {
+		if quality.AccuracySource != "" && quality.AccuracySource == source {
+			return rejectAccuracySource
+		}
+	}
+	return ""
+}
+
+// acceptLocationQuality checks a point against the quality gate, counting it if it is rejected
+func acceptLocationQuality(quality locationQuality) bool {
+	reason := locationQualityRejection(quality)
+	if reason == "" {
+		return true
+	}
+	rejectedPoints.WithLabelValues(reason).Inc()
+	return false
+}
+
+// acceptPacketLocationQuality is acceptLocationQuality for a stored packet
+func acceptPacketLocationQuality(packet types.Packet) (bool, error) {
+	quality, err := packetLocationQuality(packet)
+	if err != nil {
+		return false, err
+	}
+	return acceptLocationQuality(quality), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+func TestLocationQualityRejection(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	myConfiguration.MaxAccuracyMeters = 50
+	myConfiguration.MaxHdop = 2
+	myConfiguration.MinSatellites = 4
+	myConfiguration.ExcludedAccuracySources = []string{"ip"}
+
+	accuracy, hdop, satellites := 100.0, 5.0, int32(3)
+	tests := []struct {
+		quality locationQuality
+		want    string
+	}{
+		{locationQuality{}, ""},
+		{locationQuality{AccuracySource: "gps"}, ""},
+		{locationQuality{AccuracyMeters: &accuracy}, rejectAccuracy},
+		{locationQuality{Hdop: &hdop}, rejectHdop},
+		{locationQuality{Satellites: &satellites}, rejectSatellites},
+		{locationQuality{AccuracySource: "ip"}, rejectAccuracySource},
+	}
+	for i, test := range tests {
+		if got := locationQualityRejection(test.quality); got != test.want {
+			t.Errorf("%d: got %q, want %q", i, got, test.want)
+		}
+	}
+
+	// Live uplinks omit unreported values as zero
+	if got := locationQualityRejection(messageLocationQuality(types.TtnMapperUplinkMessage{})); got != "" {
+		t.Errorf("unreported values rejected for %q", got)
+	}
+}
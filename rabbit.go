@@ -3,168 +3,225 @@ package main
 import (
 	"github.com/streadway/amqp"
 	"log"
+	"sync"
+	"time"
+)
+
+const (
+	amqpReconnectMinBackoff = 1 * time.Second
+	amqpReconnectMaxBackoff = 60 * time.Second
 )
 
 var (
 	newDataChannel      = make(chan amqp.Delivery)
 	gatewayMovedChannel = make(chan amqp.Delivery)
+
+	// Done when every subscriber has stopped and closed its connection
+	amqpSubscribers sync.WaitGroup
 )
 
 func subscribeToRabbitNewData() {
-	// Start thread that listens for new amqp messages
-	conn, err := amqp.Dial("amqp://" + myConfiguration.AmqpUser + ":" + myConfiguration.AmqpPassword + "@" + myConfiguration.AmqpHost + ":" + myConfiguration.AmqpPort + "/")
-	failOnError(err, "Failed to connect to RabbitMQ")
-	defer conn.Close()
-
-	// Create a channel for errors
-	notify := conn.NotifyClose(make(chan *amqp.Error)) //error channel
-
-	ch, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer ch.Close()
-
-	err = ch.ExchangeDeclare(
-		myConfiguration.AmqpExchangeInsertedData, // name
-		"fanout",                                 // type
-		true,                                     // durable
-		false,                                    // auto-deleted
-		false,                                    // internal
-		false,                                    // no-wait
-		nil,                                      // arguments
-	)
-	failOnError(err, "Failed to declare an exchange")
-
-	q, err := ch.QueueDeclare(
-		myConfiguration.AmqpQueueInsertedData, // name
-		false,                                 // durable
-		false,                                 // delete when unused
-		false,                                 // exclusive
-		false,                                 // no-wait
-		nil,                                   // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	err = ch.Qos(
-		10,    // prefetch count
-		0,     // prefetch size
-		false, // global
-	)
-	failOnError(err, "Failed to set queue QoS")
-
-	err = ch.QueueBind(
-		q.Name,                                   // queue name
-		"",                                       // routing key
-		myConfiguration.AmqpExchangeInsertedData, // exchange
-		false,
-		nil)
-	failOnError(err, "Failed to bind a queue")
+	subscribeToRabbit(myConfiguration.AmqpExchangeInsertedData, myConfiguration.AmqpQueueInsertedData, newDataChannel)
+}
 
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	failOnError(err, "Failed to register a consumer")
+func subscribeToRabbitMovedGateway() {
+	subscribeToRabbit(myConfiguration.AmqpExchangeGatewayMoved, myConfiguration.AmqpQueueGatewayMoved, gatewayMovedChannel)
+}
 
-	log.Println("AMQP new data started")
+func amqpUrl() string {
+	return "amqp://" + myConfiguration.AmqpUser + ":" + myConfiguration.AmqpPassword + "@" + myConfiguration.AmqpHost + ":" + myConfiguration.AmqpPort + "/"
+}
 
-waitForMessages:
-	for {
-		select {
-		case err := <-notify:
-			if err != nil {
-				log.Println(err.Error())
+// subscribeToRabbit keeps a consumer running on the given exchange and queue and forwards all deliveries to the
+// deliveries channel. Whenever the connection or channel is lost it reconnects with exponential backoff, so that
+// a broker restart does not take down the whole service. When the service stops, the deliveries channel is closed.
+func subscribeToRabbit(exchange string, queue string, deliveries chan amqp.Delivery) {
+	defer amqpSubscribers.Done()
+	backoff := amqpReconnectMinBackoff
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			log.Printf("Reconnecting to AMQP exchange %s in %s", exchange, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-stopping:
+				close(deliveries)
+				return
 			}
-			break waitForMessages
-		case d := <-msgs:
-			log.Printf(" [a] New data received")
-			newDataChannel <- d
+			amqpReconnectAttempts.WithLabelValues(exchange).Inc()
+		}
+
+		consumed, err := consumeFromRabbit(exchange, queue, deliveries)
+		if err == errShuttingDown {
+			return
+		}
+		if err != nil {
+			log.Printf("AMQP exchange %s: %s", exchange, err.Error())
+			amqpConnectFailures.WithLabelValues(exchange).Inc()
 		}
+
+		backoff = nextReconnectBackoff(backoff, consumed)
 	}
+}
 
-	log.Fatal("New data subscribe channel closed")
+// nextReconnectBackoff doubles the backoff up to the maximum. It only backs off further if we could not even get the
+// consumer running.
+func nextReconnectBackoff(backoff time.Duration, consumed bool) time.Duration {
+	if consumed {
+		return amqpReconnectMinBackoff
+	}
+	backoff *= 2
+	if backoff > amqpReconnectMaxBackoff {
+		backoff = amqpReconnectMaxBackoff
+	}
+	return backoff
 }
 
-func subscribeToRabbitMovedGateway() {
-	// Start thread that listens for new amqp messages
-	conn, err := amqp.Dial("amqp://" + myConfiguration.AmqpUser + ":" + myConfiguration.AmqpPassword + "@" + myConfiguration.AmqpHost + ":" + myConfiguration.AmqpPort + "/")
-	failOnError(err, "Failed to connect to RabbitMQ")
+// consumeFromRabbit connects to the broker, (re-)declares the exchange, queue and binding, and forwards deliveries
+// until the connection or channel closes. consumed is true if the consumer was registered successfully.
+// On shutdown it stops consuming and closes the deliveries channel, but keeps the connection open until the
+// processed deliveries are acked, and then returns errShuttingDown.
+func consumeFromRabbit(exchange string, queue string, deliveries chan amqp.Delivery) (consumed bool, err error) {
+	conn, err := amqp.Dial(amqpUrl())
+	if err != nil {
+		return false, err
+	}
 	defer conn.Close()
 
 	// Create a channel for errors
-	notify := conn.NotifyClose(make(chan *amqp.Error)) //error channel
+	notify := conn.NotifyClose(make(chan *amqp.Error, 1)) //error channel, buffered so the library never blocks on it
 
 	ch, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
+	if err != nil {
+		return false, err
+	}
 	defer ch.Close()
 
+	channelNotify := ch.NotifyClose(make(chan *amqp.Error, 1))
+
 	err = ch.ExchangeDeclare(
-		myConfiguration.AmqpExchangeGatewayMoved, // name
-		"fanout",                                 // type
-		true,                                     // durable
-		false,                                    // auto-deleted
-		false,                                    // internal
-		false,                                    // no-wait
-		nil,                                      // arguments
+		exchange, // name
+		"fanout", // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
 	)
-	failOnError(err, "Failed to declare an exchange")
+	if err != nil {
+		return false, err
+	}
 
 	q, err := ch.QueueDeclare(
-		myConfiguration.AmqpQueueGatewayMoved, // name
-		false,                                 // durable
-		false,                                 // delete when unused
-		false,                                 // exclusive
-		false,                                 // no-wait
-		nil,                                   // arguments
+		queue,                         // name
+		myConfiguration.AmqpManualAck, // durable
+		false,                         // delete when unused
+		false,                         // exclusive
+		false,                         // no-wait
+		nil,                           // arguments
 	)
-	failOnError(err, "Failed to declare a queue")
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.PreconditionFailed {
+		// Retrying can not fix this, see the README on switching AMQP_MANUAL_ACK
+		log.Fatalf("AMQP queue %s exists with a different durability than AMQP_MANUAL_ACK=%t asks for: %s", queue, myConfiguration.AmqpManualAck, amqpErr.Reason)
+	}
+	if err != nil {
+		return false, err
+	}
 
 	err = ch.Qos(
-		10,    // prefetch count
-		0,     // prefetch size
-		false, // global
+		myConfiguration.AmqpPrefetchCount, // prefetch count
+		0,                                 // prefetch size
+		false,                             // global
 	)
-	failOnError(err, "Failed to set queue QoS")
+	if err != nil {
+		return false, err
+	}
 
 	err = ch.QueueBind(
-		q.Name,                                   // queue name
-		"",                                       // routing key
-		myConfiguration.AmqpExchangeGatewayMoved, // exchange
+		q.Name,   // queue name
+		"",       // routing key
+		exchange, // exchange
 		false,
 		nil)
-	failOnError(err, "Failed to bind a queue")
+	if err != nil {
+		return false, err
+	}
 
+	consumerTag := "gridcell-" + queue
 	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
+		q.Name,                         // queue
+		consumerTag,                    // consumer
+		!myConfiguration.AmqpManualAck, // auto-ack
+		false,                          // exclusive
+		false,                          // no-local
+		false,                          // no-wait
+		nil,                            // args
 	)
-	failOnError(err, "Failed to register a consumer")
+	if err != nil {
+		return false, err
+	}
 
-	log.Println("AMQP gateway moved started")
+	log.Println("AMQP", exchange, "started")
 
-waitForMessages:
 	for {
 		select {
+		case <-stopping:
+			return true, stopConsuming(ch, consumerTag, deliveries, notify)
 		case err := <-notify:
 			if err != nil {
-				log.Println(err.Error())
+				return true, err
+			}
+			return true, nil
+		case err := <-channelNotify:
+			if err != nil {
+				return true, err
+			}
+			return true, nil
+		case d, ok := <-msgs:
+			if !ok {
+				log.Println("AMQP", exchange, "consumer closed")
+				return true, nil
+			}
+			log.Printf(" [a] Message received on %s", exchange)
+			select {
+			case deliveries <- d:
+			case <-stopping:
+				// Not processed, so with manual acks it is requeued when the channel closes
+				return true, stopConsuming(ch, consumerTag, deliveries, notify)
 			}
-			break waitForMessages
-		case d := <-msgs:
-			log.Printf(" [a] Gateway move received")
-			gatewayMovedChannel <- d
 		}
 	}
+}
 
-	log.Fatal("Gateway moved subscribe channel closed")
+func stopConsuming(ch *amqp.Channel, consumerTag string, deliveries chan amqp.Delivery, notify chan *amqp.Error) error {
+	if err := ch.Cancel(consumerTag, false); err != nil {
+		log.Println(err.Error())
+	}
+	close(deliveries)
 
+	select {
+	case <-amqpDrained:
+	case <-notify:
+		// Lost the connection while draining, unacked messages will be redelivered
+	}
+	return errShuttingDown
+}
+
+// ackDelivery settles a delivery after it has been processed. It only has an effect when manual acks are enabled,
+// as auto-acked deliveries have already been removed from the queue. Failed deliveries are requeued so that they are
+// retried, unless requeue is false, which is used for messages that will never succeed like invalid JSON.
+func ackDelivery(d amqp.Delivery, err error, requeue bool) {
+	if !myConfiguration.AmqpManualAck {
+		return
+	}
+
+	var ackErr error
+	if err == nil {
+		ackErr = d.Ack(false)
+	} else {
+		ackErr = d.Nack(false, requeue)
+	}
+	if ackErr != nil {
+		log.Println(ackErr.Error())
+	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+// testAcknowledger records how a delivery was settled
+type testAcknowledger struct {
+	acks     int
+	nacks    int
+	requeued bool
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks++
+	a.requeued = requeue
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestAckDelivery(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+
+	// Auto-acked deliveries are already gone from the queue
+	myConfiguration.AmqpManualAck = false
+	acknowledger := &testAcknowledger{}
+	ackDelivery(amqp.Delivery{Acknowledger: acknowledger}, nil, false)
+	if acknowledger.acks != 0 || acknowledger.nacks != 0 {
+		t.Fatalf("auto-acked delivery settled: %+v", acknowledger)
+	}
+
+	myConfiguration.AmqpManualAck = true
+	acknowledger = &testAcknowledger{}
+	ackDelivery(amqp.Delivery{Acknowledger: acknowledger}, nil, false)
+	if acknowledger.acks != 1 || acknowledger.nacks != 0 {
+		t.Fatalf("successful delivery not acked: %+v", acknowledger)
+	}
+
+	acknowledger = &testAcknowledger{}
+	ackDelivery(amqp.Delivery{Acknowledger: acknowledger}, errShuttingDown, true)
+	if acknowledger.acks != 0 || acknowledger.nacks != 1 || !acknowledger.requeued {
+		t.Fatalf("failed delivery not requeued: %+v", acknowledger)
+	}
+}
+
+func TestNextReconnectBackoff(t *testing.T) {
+	backoff := amqpReconnectMinBackoff
+	for i := 0; i < 10; i++ {
+		backoff = nextReconnectBackoff(backoff, false)
+	}
+	if backoff != amqpReconnectMaxBackoff {
+		t.Fatalf("got %s, want the maximum %s", backoff, amqpReconnectMaxBackoff)
+	}
+	if next := nextReconnectBackoff(amqpReconnectMinBackoff, false); next != 2*amqpReconnectMinBackoff {
+		t.Fatalf("got %s, want double the minimum", next)
+	}
+	if next := nextReconnectBackoff(backoff, true); next != amqpReconnectMinBackoff {
+		t.Fatalf("got %s, want a reset to the minimum after consuming", next)
+	}
+}
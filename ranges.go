@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// NetworkRange is the maximum range of the gateways in the networks with an ID starting with the prefix, like
+// "NS_HELIUM" or "NS_TTS_V3://ttn@"
+type NetworkRange struct {
+	NetworkIdPrefix string
+	MaximumRangeKm  float64
+}
+
+// networkMaximumRangeKm returns the range of the longest configured prefix matching the network, or the global range
+func networkMaximumRangeKm(networkId string) float64 {
+	maximumRangeKm := myConfiguration.GatewayMaximumRangeKm
+	longest := -1
+	for _, networkRange := range myConfiguration.NetworkMaximumRanges {
+		if strings.HasPrefix(networkId, networkRange.NetworkIdPrefix) && len(networkRange.NetworkIdPrefix) > longest {
+			maximumRangeKm = networkRange.MaximumRangeKm
+			longest = len(networkRange.NetworkIdPrefix)
+		}
+	}
+	return maximumRangeKm
+}
+
+// gatewayMaximumRangeKm returns the maximum distance of points from a gateway, from its override or its network
+func gatewayMaximumRangeKm(gatewayIndexer types.GatewayIndexer) (float64, error) {
+	override, ok := gatewayRangeDbCache.Get(gatewayIndexer)
+	if !ok {
+		var overrides []types.GatewayRangeOverride
+		err := db.Where(&types.GatewayRangeOverride{NetworkId: gatewayIndexer.NetworkId, GatewayId: gatewayIndexer.GatewayId}).
+			Limit(1).Find(&overrides).Error
+		if err != nil {
+			return 0, err
+		}
+		if len(overrides) > 0 {
+			override = &overrides[0]
+		}
+		gatewayRangeDbCache.Set(gatewayIndexer, override)
+	}
+
+	if override != nil {
+		return override.MaximumRangeKm, nil
+	}
+	return networkMaximumRangeKm(gatewayIndexer.NetworkId), nil
+}
+
+// networksMaximumRangeKm returns the largest range of any gateway in the networks, to search for gateways near a point
+func networksMaximumRangeKm(networkIds []string) (float64, error) {
+	maximumRangeKm := 0.0
+	for _, networkId := range networkIds {
+		if networkRangeKm := networkMaximumRangeKm(networkId); networkRangeKm > maximumRangeKm {
+			maximumRangeKm = networkRangeKm
+		}
+	}
+
+	sortedIds := append([]string{}, networkIds...)
+	sort.Strings(sortedIds)
+	cacheKey := strings.Join(sortedIds, "\n")
+	overrideRangeKm, ok := networksRangeDbCache.Get(cacheKey)
+	if !ok {
+		err := db.Model(&types.GatewayRangeOverride{}).Select("max(maximum_range_km)").Where("network_id IN ?", networkIds).
+			Row().Scan(&overrideRangeKm)
+		if err != nil {
+			return 0, err
+		}
+		networksRangeDbCache.Set(cacheKey, overrideRangeKm)
+	}
+	if overrideRangeKm != nil && *overrideRangeKm > maximumRangeKm {
+		maximumRangeKm = *overrideRangeKm
+	}
+	return maximumRangeKm, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+func TestNetworkMaximumRangeKm(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	myConfiguration.GatewayMaximumRangeKm = 200
+	myConfiguration.NetworkMaximumRanges = []NetworkRange{
+		{NetworkIdPrefix: types.NS_TTS_V3, MaximumRangeKm: 100},
+		{NetworkIdPrefix: types.NS_TTS_V3 + "://ttn@", MaximumRangeKm: 150},
+		{NetworkIdPrefix: types.NS_CHIRP, MaximumRangeKm: 50},
+	}
+
+	tests := []struct {
+		networkId string
+		want      float64
+	}{
+		{types.NS_TTN_V2 + "://ttn", 200},
+		{types.NS_TTS_V3 + "://ttn@000013", 150},
+		{types.NS_TTS_V3 + "://other@000013", 100},
+		{types.NS_CHIRP + "://example", 50},
+	}
+	for _, test := range tests {
+		if got := networkMaximumRangeKm(test.networkId); got != test.want {
+			t.Errorf("%s: got %f, want %f", test.networkId, got, test.want)
+		}
+	}
+}
+
+func TestNetworksMaximumRangeKm(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	useUnreachableDb(t)
+	myConfiguration.GatewayMaximumRangeKm = 200
+	myConfiguration.NetworkMaximumRanges = nil
+
+	// The override is looked up once per set of networks, whatever their order
+	overrideRangeKm := 300.0
+	networksRangeDbCache.Set(types.NS_CHIRP+"\n"+types.NS_TTN_V2, &overrideRangeKm)
+	networksRangeDbCache.Set(types.NS_TTN_V2, nil)
+	t.Cleanup(func() {
+		networksRangeDbCache.Delete(types.NS_CHIRP + "\n" + types.NS_TTN_V2)
+		networksRangeDbCache.Delete(types.NS_TTN_V2)
+	})
+
+	if got, err := networksMaximumRangeKm([]string{types.NS_TTN_V2, types.NS_CHIRP}); err != nil || got != 300 {
+		t.Errorf("got %f, %v, want the override", got, err)
+	}
+	if got, err := networksMaximumRangeKm([]string{types.NS_TTN_V2}); err != nil || got != 200 {
+		t.Errorf("got %f, %v, want the network range", got, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	// Closed when the service should stop taking on new work
+	stopping = make(chan struct{})
+
+	// Closed once all received messages are processed and their grid cells are stored, so that their acks can still
+	// be sent before the AMQP connections are closed
+	amqpDrained = make(chan struct{})
+
+	errShuttingDown = errors.New("shutting down")
+)
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleSignals starts the shutdown on SIGINT or SIGTERM. If the shutdown does not complete within the configured
+// deadline, or a second signal arrives, the process exits immediately.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	timeout := time.Duration(myConfiguration.ShutdownTimeoutSeconds) * time.Second
+	watchSignals(signals, timeout, log.Fatalln)
+}
+
+// watchSignals closes stopping on the first signal, and calls exit when the timeout passes or another signal arrives
+func watchSignals(signals <-chan os.Signal, timeout time.Duration, exit func(v ...interface{})) {
+	sig := <-signals
+	log.Println("Received", sig, "- shutting down")
+	close(stopping)
+
+	select {
+	case <-time.After(timeout):
+		exit("Shutdown did not complete within", timeout)
+	case sig = <-signals:
+		exit("Received", sig, "again - exiting")
+	}
+}
+
+func closeDatabase() {
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Println(err.Error())
+	}
+}
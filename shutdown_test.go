@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchSignals(t *testing.T) {
+	defer func(previous chan struct{}) { stopping = previous }(stopping)
+
+	tests := []struct {
+		name       string
+		signals    []os.Signal
+		timeout    time.Duration
+		wantReason string
+	}{
+		{"deadline", []os.Signal{syscall.SIGTERM}, 10 * time.Millisecond, "Shutdown did not complete within"},
+		{"second signal", []os.Signal{syscall.SIGTERM, syscall.SIGINT}, time.Hour, "Received"},
+	}
+	for _, test := range tests {
+		stopping = make(chan struct{})
+		signals := make(chan os.Signal, len(test.signals))
+		for _, sig := range test.signals {
+			signals <- sig
+		}
+
+		exited := make(chan string, 1)
+		watchSignals(signals, test.timeout, func(v ...interface{}) { exited <- v[0].(string) })
+
+		if !isStopping() {
+			t.Errorf("%s: stopping not closed", test.name)
+		}
+		if reason := <-exited; reason != test.wantReason {
+			t.Errorf("%s: exited with %q, want %q", test.name, reason, test.wantReason)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"github.com/j4/gosm"
+	"math"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+// A point with a poor accuracy could be anywhere in its accuracy circle, which can be many tiles wide at high zoom
+// levels. Smearing spreads it over the cells the circle covers. H3 cells are not smeared.
+
+// Smear modes
+const (
+	// Count the point as before, and add the fraction of the circle in each cell it covers to the weights
+	smearModeFraction = "fraction"
+	// Only count the point at zoom levels with tiles as wide as the circle
+	smearModeCoarsest = "coarsest"
+)
+
+// Matches the earth radius used by haversine
+const metersPerDegreeLatitude = 6371000 * math.Pi / 180
+
+// Number of sample points along each side of the part of a tile that the accuracy circle can cover
+const smearTileSamples = 8
+
+// Spreading a point over more tiles than this at one zoom level costs more than it tells, so the point is only
+// counted at the coarser zoom levels that fit
+const smearMaxTiles = 1024
+
+func validateSmearMode() error {
+	switch myConfiguration.SmearMode {
+	case "", smearModeFraction, smearModeCoarsest:
+		return nil
+	default:
+		return errors.New("unknown smear mode " + myConfiguration.SmearMode)
+	}
+}
+
+// tileWidthMeters returns the width of a tile at the given latitude and zoom level
+func tileWidthMeters(latitude float64, zoom int) float64 {
+	return 360 * metersPerDegreeLatitude * math.Cos(latitude*math.Pi/180) / math.Exp2(float64(zoom))
+}
+
+// smearGridCells spreads the cells of one point over its accuracy circle. The cells must contain only that point,
+// as returned by getGridCells and incremented. Points without a known accuracy are not smeared.
+func smearGridCells(gridCells []types.GridCell, latitude float64, longitude float64, accuracyMeters *float64) []types.GridCell {
+	if accuracyMeters == nil || *accuracyMeters <= 0 {
+		return gridCells
+	}
+
+	switch myConfiguration.SmearMode {
+	case smearModeCoarsest:
+		return coarsestGridCells(gridCells, latitude, *accuracyMeters)
+	case smearModeFraction:
+		return fractionGridCells(gridCells, latitude, longitude, *accuracyMeters)
+	default:
+		return gridCells
+	}
+}
+
+// coarsestGridCells keeps the cells with tiles at least as wide as the accuracy circle. If there are none the cells
+// at the coarsest zoom level are kept, so that the point is still counted.
+func coarsestGridCells(gridCells []types.GridCell, latitude float64, accuracyMeters float64) []types.GridCell {
+	kept := make([]types.GridCell, 0, len(gridCells))
+	coarsest := -1
+	for _, gridCell := range gridCells {
+		if tileWidthMeters(latitude, gridCell.Z) >= 2*accuracyMeters {
+			kept = append(kept, gridCell)
+		}
+		if coarsest == -1 || gridCell.Z < coarsest {
+			coarsest = gridCell.Z
+		}
+	}
+	if len(kept) > 0 {
+		return kept
+	}
+
+	for _, gridCell := range gridCells {
+		if gridCell.Z == coarsest {
+			kept = append(kept, gridCell)
+		}
+	}
+	return kept
+}
+
+// tileXY identifies a tile at a known zoom level
+type tileXY struct {
+	X int
+	Y int
+}
+
+// fractionGridCells scales the weights of every cell by the fraction of the accuracy circle inside it, and adds cells
+// with only weights for the other tiles the circle covers. Counts and statistics stay in the cell of the reported
+// location. Zoom levels at which the circle covers too many tiles are left out. If that leaves none, the cells at the
+// coarsest zoom level are kept as they are, so that the point is still counted.
+func fractionGridCells(gridCells []types.GridCell, latitude float64, longitude float64, accuracyMeters float64) []types.GridCell {
+	fractionsPerZoom := map[int]map[tileXY]float64{}
+	coarsest := -1
+	fits := false
+	for _, gridCell := range gridCells {
+		if _, ok := fractionsPerZoom[gridCell.Z]; ok {
+			continue
+		}
+		fractions := circleTileFractions(latitude, longitude, accuracyMeters, gridCell.Z)
+		fractionsPerZoom[gridCell.Z] = fractions
+		if fractions != nil {
+			fits = true
+		}
+		if coarsest == -1 || gridCell.Z < coarsest {
+			coarsest = gridCell.Z
+		}
+	}
+
+	smeared := make([]types.GridCell, 0, len(gridCells))
+	for _, gridCell := range gridCells {
+		fractions := fractionsPerZoom[gridCell.Z]
+		if fractions == nil {
+			if !fits && gridCell.Z == coarsest {
+				smeared = append(smeared, gridCell)
+			}
+			continue
+		}
+
+		for tile, fraction := range fractions {
+			if tile.X == gridCell.X && tile.Y == gridCell.Y {
+				centre := gridCell
+				scaleSignalWeights(&centre.SignalBuckets, fraction)
+				smeared = append(smeared, centre)
+				continue
+			}
+
+			neighbour := types.GridCell{
+				AntennaID:      gridCell.AntennaID,
+				X:              tile.X,
+				Y:              tile.Y,
+				Z:              gridCell.Z,
+				DataRateID:     gridCell.DataRateID,
+				FrequencyBand:  gridCell.FrequencyBand,
+				BucketSchemaID: gridCell.BucketSchemaID,
+			}
+			neighbour.LastUpdated = gridCell.LastUpdated
+			neighbour.SignalWeights = gridCell.SignalWeights
+			scaleSignalWeights(&neighbour.SignalBuckets, fraction)
+			smeared = append(smeared, neighbour)
+		}
+	}
+	return smeared
+}
+
+// circleTileFractions estimates which fraction of the circle lies in each tile at the zoom level. Every tile in the
+// range covering the circle is sampled on its own, so that no tile is skipped. The tile of the centre is always
+// included, so that the counts kept in its cell are never lost. It returns nil if the range has more than
+// smearMaxTiles tiles.
+func circleTileFractions(latitude float64, longitude float64, radiusMeters float64, zoom int) map[tileXY]float64 {
+	centre := gosm.NewTileWithLatLong(latitude, longitude, zoom)
+	centreTile := tileXY{X: centre.X, Y: centre.Y}
+
+	metersPerDegreeLongitude := metersPerDegreeLatitude * math.Cos(latitude*math.Pi/180)
+	minLatitude := math.Max(latitude-radiusMeters/metersPerDegreeLatitude, -85)
+	maxLatitude := math.Min(latitude+radiusMeters/metersPerDegreeLatitude, 85)
+	minLongitude := math.Max(longitude-radiusMeters/metersPerDegreeLongitude, -180)
+	maxLongitude := math.Min(longitude+radiusMeters/metersPerDegreeLongitude, 180)
+
+	// Tile rows are numbered from the north
+	northWest := gosm.NewTileWithLatLong(maxLatitude, minLongitude, zoom)
+	southEast := gosm.NewTileWithLatLong(minLatitude, maxLongitude, zoom)
+	lastTile := 1<<uint(zoom) - 1
+	if southEast.X > lastTile {
+		southEast.X = lastTile
+	}
+	if southEast.Y > lastTile {
+		southEast.Y = lastTile
+	}
+	if northWest.X == southEast.X && northWest.Y == southEast.Y {
+		return map[tileXY]float64{centreTile: 1}
+	}
+	if (southEast.X-northWest.X+1)*(southEast.Y-northWest.Y+1) > smearMaxTiles {
+		return nil
+	}
+
+	weights := map[tileXY]float64{}
+	total := 0.0
+	for x := northWest.X; x <= southEast.X; x++ {
+		for y := northWest.Y; y <= southEast.Y; y++ {
+			north, west := gosm.NewTileWithXY(x, y, zoom).Num2deg()
+			south, east := gosm.NewTileWithXY(x+1, y+1, zoom).Num2deg()
+
+			// Only the part of the tile inside the bounding box of the circle is sampled, so the samples are never
+			// further apart than a quarter of the radius
+			north, south = math.Min(north, maxLatitude), math.Max(south, minLatitude)
+			west, east = math.Max(west, minLongitude), math.Min(east, maxLongitude)
+			if north <= south || east <= west {
+				continue
+			}
+
+			inside := 0
+			for i := 0; i < smearTileSamples; i++ {
+				sampleLatitude := south + (north-south)*(float64(i)+0.5)/smearTileSamples
+				dy := (sampleLatitude - latitude) * metersPerDegreeLatitude
+				for j := 0; j < smearTileSamples; j++ {
+					sampleLongitude := west + (east-west)*(float64(j)+0.5)/smearTileSamples
+					dx := (sampleLongitude - longitude) * metersPerDegreeLongitude
+					if dx*dx+dy*dy <= radiusMeters*radiusMeters {
+						inside++
+					}
+				}
+			}
+			if inside == 0 {
+				continue
+			}
+
+			// The sampled parts differ in size, so they are weighted by their area
+			weight := (north - south) * (east - west) * float64(inside) / (smearTileSamples * smearTileSamples)
+			weights[tileXY{X: x, Y: y}] = weight
+			total += weight
+		}
+	}
+	if total == 0 {
+		return map[tileXY]float64{centreTile: 1}
+	}
+
+	fractions := map[tileXY]float64{centreTile: 0}
+	for tile, weight := range weights {
+		fractions[tile] = weight / total
+	}
+	return fractions
+}
+
+func scaleSignalWeights(buckets *types.SignalBuckets, factor float64) {
+	for _, weight := range signalWeights(buckets) {
+		*weight *= factor
+	}
+}
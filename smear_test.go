@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+	"ttnmapper-postgres-insert-gridcell/types"
+)
+
+func TestSmearGridCells(t *testing.T) {
+	defer func(configuration Configuration) { myConfiguration = configuration }(myConfiguration)
+	myConfiguration.GridCellZoomLevels = []int{12, 19}
+
+	newCells := func() []types.GridCell {
+		gridCells, err := getGridCells(1, 52.0, 5.0, []cellDimension{{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range gridCells {
+			incrementBucket(&gridCells[i].SignalBuckets, time.Now(), -90, nil, 5)
+		}
+		return gridCells
+	}
+	accuracy := 500.0
+
+	myConfiguration.SmearMode = smearModeCoarsest
+	coarsest := smearGridCells(newCells(), 52.0, 5.0, &accuracy)
+	if len(coarsest) != 1 || coarsest[0].Z != 12 {
+		t.Fatalf("got %+v, want only zoom 12", coarsest)
+	}
+	accuracy = 50000
+	coarsest = smearGridCells(newCells(), 52.0, 5.0, &accuracy)
+	if len(coarsest) != 1 || coarsest[0].Z != 12 {
+		t.Fatalf("got %+v, want the coarsest zoom if none fit", coarsest)
+	}
+
+	myConfiguration.SmearMode = smearModeFraction
+	accuracy = 500
+	smeared := smearGridCells(newCells(), 52.0, 5.0, &accuracy)
+	weights := map[int]float64{}
+	counts := map[int]uint32{}
+	cells := map[int]int{}
+	for _, gridCell := range smeared {
+		weights[gridCell.Z] += gridCell.WeightHigh
+		counts[gridCell.Z] += gridCell.BucketHigh
+		cells[gridCell.Z]++
+	}
+	for _, zoom := range myConfiguration.GridCellZoomLevels {
+		if math.Abs(weights[zoom]-1) > 1e-9 || counts[zoom] != 1 {
+			t.Errorf("zoom %d: got weight %f and count %d, want 1 and 1", zoom, weights[zoom], counts[zoom])
+		}
+	}
+	if cells[19] < 100 {
+		t.Errorf("got %d cells at zoom 19, want the circle spread over many", cells[19])
+	}
+
+	// Zoom levels at which the circle covers too many tiles are left out, keeping the point in its centre cell at the
+	// others
+	accuracy = 50000
+	centre, err := getGridCell(1, 52.0, 5.0, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smeared = smearGridCells(newCells(), 52.0, 5.0, &accuracy)
+	weight := 0.0
+	var count uint32
+	for _, gridCell := range smeared {
+		if gridCell.Z != 12 {
+			t.Fatalf("got a cell at zoom %d, want only zoom 12", gridCell.Z)
+		}
+		if gridCell.X == centre.X && gridCell.Y == centre.Y {
+			count += gridCell.BucketHigh
+		}
+		weight += gridCell.WeightHigh
+	}
+	if count != 1 {
+		t.Errorf("centre cell counts %d, want 1", count)
+	}
+	if len(smeared) > smearMaxTiles || math.Abs(weight-1) > 1e-9 {
+		t.Errorf("got %d cells with weight %f, want the circle spread at zoom 12", len(smeared), weight)
+	}
+
+	// If no zoom level fits, the point stays unsmeared at the coarsest one
+	accuracy = 2000000
+	if smeared := smearGridCells(newCells(), 52.0, 5.0, &accuracy); len(smeared) != 1 || smeared[0].Z != 12 || smeared[0].BucketHigh != 1 {
+		t.Errorf("got %+v, want only the zoom 12 cell", smeared)
+	}
+
+	// Points without a known accuracy are not smeared
+	if unsmeared := smearGridCells(newCells(), 52.0, 5.0, nil); len(unsmeared) != 2 {
+		t.Errorf("got %d cells, want 2", len(unsmeared))
+	}
+}
+
+func TestCircleTileFractions(t *testing.T) {
+	// A circle much wider than the tiles covers all of them, about as many as fit in its area
+	latitude, longitude, radius := 52.0, 5.0, 600.0
+	fractions := circleTileFractions(latitude, longitude, radius, 19)
+	tileWidth := tileWidthMeters(latitude, 19)
+	want := math.Pi * radius * radius / (tileWidth * tileWidth)
+	if got := float64(len(fractions)); got < 0.9*want || got > 1.1*want {
+		t.Fatalf("got %d tiles, want about %.0f", len(fractions), want)
+	}
+
+	total := 0.0
+	for _, fraction := range fractions {
+		total += fraction
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Fatalf("fractions add up to %f", total)
+	}
+
+	// Beyond the limit the circle is not spread at all
+	if fractions := circleTileFractions(latitude, longitude, 3000, 19); fractions != nil {
+		t.Fatalf("got %d tiles, want none", len(fractions))
+	}
+
+	// A circle inside a single tile stays there
+	centre, err := getGridCell(1, latitude, longitude, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fractions = circleTileFractions(latitude, longitude, 10, 12)
+	if len(fractions) != 1 || fractions[tileXY{X: centre.X, Y: centre.Y}] != 1 {
+		t.Fatalf("got %v, want only the centre tile", fractions)
+	}
+}
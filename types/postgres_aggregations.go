@@ -8,8 +8,18 @@ type GridCell struct {
 
 	X int `gorm:"UNIQUE_INDEX:idx_grid_cell"`
 	Y int `gorm:"UNIQUE_INDEX:idx_grid_cell"`
-	// Z is always 19
+	// Slippy map zoom level of the tile. Coarser levels contain the sum of the z19 cells they cover.
+	Z int `gorm:"UNIQUE_INDEX:idx_grid_cell;default:19"`
+	// Cells split by data rate and frequency band, if enabled. 0 and "" count all packets.
+	DataRateID    uint   `gorm:"UNIQUE_INDEX:idx_grid_cell"`
+	FrequencyBand string `gorm:"type:text;UNIQUE_INDEX:idx_grid_cell"`
 
+	BucketSchemaID uint
+	SignalBuckets  `gorm:"embedded"`
+}
+
+// SignalBuckets counts packets per signal strength band. It is shared by all cell types.
+type SignalBuckets struct {
 	LastUpdated time.Time
 
 	BucketHigh     uint32
@@ -25,10 +35,161 @@ type GridCell struct {
 	Bucket145      uint32
 	BucketLow      uint32
 	BucketNoSignal uint32
+
+	SignalStatistics `gorm:"embedded"`
+	SignalWeights    `gorm:"embedded"`
+}
+
+// SignalWeights are the bucket counts with every packet decaying with the configured half life, valued at the
+// LastUpdated time of the cell. To get the current weight multiply by 0.5^((now - LastUpdated) / half life). Smeared
+// points add the fraction of their accuracy circle in the cell. They are only maintained when decay or fractional
+// smearing is enabled.
+type SignalWeights struct {
+	WeightHigh     float64 `gorm:"type:double precision"`
+	Weight100      float64 `gorm:"type:double precision"`
+	Weight105      float64 `gorm:"type:double precision"`
+	Weight110      float64 `gorm:"type:double precision"`
+	Weight115      float64 `gorm:"type:double precision"`
+	Weight120      float64 `gorm:"type:double precision"`
+	Weight125      float64 `gorm:"type:double precision"`
+	Weight130      float64 `gorm:"type:double precision"`
+	Weight135      float64 `gorm:"type:double precision"`
+	Weight140      float64 `gorm:"type:double precision"`
+	Weight145      float64 `gorm:"type:double precision"`
+	WeightLow      float64 `gorm:"type:double precision"`
+	WeightNoSignal float64 `gorm:"type:double precision"`
+}
+
+// SignalStatistics are running aggregates of the packets counted in the signal buckets, from which the mean and
+// variance can be calculated. Min and max are nil until a packet is counted. Cells counted before these existed only
+// have statistics for packets added since, as shown by SignalCount.
+type SignalStatistics struct {
+	FirstSeen *time.Time
+
+	SignalCount    uint32
+	RssiSum        float64  `gorm:"type:double precision"`
+	RssiSumSquares float64  `gorm:"type:double precision"`
+	RssiMin        *float32 `gorm:"type:real"`
+	RssiMax        *float32 `gorm:"type:real"`
+	SnrSum         float64  `gorm:"type:double precision"`
+	SnrSumSquares  float64  `gorm:"type:double precision"`
+	SnrMin         *float32 `gorm:"type:real"`
+	SnrMax         *float32 `gorm:"type:real"`
 }
 
 type GridCellIndexer struct {
-	AntennaId uint
-	X         int
-	Y         int
+	AntennaId     uint
+	X             int
+	Y             int
+	Z             int
+	DataRateId    uint
+	FrequencyBand string
+}
+
+// H3Cell is the same aggregation as GridCell, but on the H3 hexagonal grid, which has a near constant cell area
+// regardless of latitude.
+type H3Cell struct {
+	ID        uint
+	AntennaID uint `gorm:"uniqueIndex:idx_h3_cell_dimensions"`
+
+	Resolution int   `gorm:"uniqueIndex:idx_h3_cell_dimensions;type:smallint"`
+	H3Index    int64 `gorm:"uniqueIndex:idx_h3_cell_dimensions"` // The h3index cast to bigint
+	// Same as for GridCell
+	DataRateID    uint   `gorm:"uniqueIndex:idx_h3_cell_dimensions"`
+	FrequencyBand string `gorm:"type:text;uniqueIndex:idx_h3_cell_dimensions"`
+
+	BucketSchemaID uint
+	SignalBuckets  `gorm:"embedded"`
+}
+
+type H3CellIndexer struct {
+	AntennaId     uint
+	Resolution    int
+	H3Index       int64
+	DataRateId    uint
+	FrequencyBand string
+}
+
+// BucketSchema describes how the signal buckets of a cell were counted. Cells counted with different schemas can not
+// be added together.
+type BucketSchema struct {
+	ID     uint
+	Metric string `gorm:"type:text;uniqueIndex:idx_bucket_schema_smear"`
+	Edges  string `gorm:"type:text;uniqueIndex:idx_bucket_schema_smear"` // Comma separated lower edges of the bands
+	// Half life of the decayed weights, 0 if they are not maintained
+	DecayHalfLifeDays float64 `gorm:"type:double precision;not null;default:0;uniqueIndex:idx_bucket_schema_smear"`
+	// How points with a poor accuracy are spread over the cells, empty if they are not
+	SmearMode string `gorm:"type:text;not null;default:'';uniqueIndex:idx_bucket_schema_smear"`
+	CreatedAt time.Time
+}
+
+// PeriodGridCell counts the packets of one period in a tile, so that coverage can be compared over time. It counts
+// all packets, regardless of data rate or frequency band.
+type PeriodGridCell struct {
+	ID        uint
+	AntennaID uint `gorm:"uniqueIndex:idx_period_grid_cell"`
+
+	X int `gorm:"uniqueIndex:idx_period_grid_cell"`
+	Y int `gorm:"uniqueIndex:idx_period_grid_cell"`
+	Z int `gorm:"uniqueIndex:idx_period_grid_cell;type:smallint"`
+	// Start of the day, week or month in UTC
+	PeriodStart time.Time `gorm:"uniqueIndex:idx_period_grid_cell;index"`
+
+	BucketSchemaID uint
+	SignalBuckets  `gorm:"embedded"`
+}
+
+type PeriodGridCellIndexer struct {
+	AntennaId   uint
+	X           int
+	Y           int
+	Z           int
+	PeriodStart time.Time
+}
+
+// GatewayRangeOverride sets the maximum range of a single gateway, taking precedence over the configured ranges
+type GatewayRangeOverride struct {
+	ID        uint
+	NetworkId string `gorm:"type:text;uniqueIndex:idx_gateway_range_override"`
+	GatewayId string `gorm:"type:text;uniqueIndex:idx_gateway_range_override"`
+
+	MaximumRangeKm float64 `gorm:"type:double precision;not null"`
+}
+
+// BlockedDevice leaves the packets of a device out of all cells, for example when its GPS is stuck. It matches the
+// device by DevEui, or by AppId and DevId, whichever are set. Packets are only left out between BlockedFrom and
+// BlockedUntil, where nil has no bound.
+type BlockedDevice struct {
+	ID     uint
+	AppId  string `gorm:"type:text;not null;default:'';index:idx_blocked_device_id"`
+	DevId  string `gorm:"type:text;not null;default:'';index:idx_blocked_device_id"`
+	DevEui string `gorm:"type:text;not null;default:'';index"`
+
+	BlockedFrom  *time.Time
+	BlockedUntil *time.Time
+	Reason       string `gorm:"type:text"`
+	CreatedAt    time.Time
+}
+
+// ExperimentGridCell counts the packets of one experiment in a tile. Experiments are kept out of the normal coverage,
+// so they get their own cells. It counts all packets, regardless of data rate or frequency band.
+type ExperimentGridCell struct {
+	ID           uint
+	ExperimentID uint `gorm:"uniqueIndex:idx_experiment_grid_cell"`
+	AntennaID    uint `gorm:"uniqueIndex:idx_experiment_grid_cell"`
+
+	X int `gorm:"uniqueIndex:idx_experiment_grid_cell"`
+	Y int `gorm:"uniqueIndex:idx_experiment_grid_cell"`
+	Z int `gorm:"uniqueIndex:idx_experiment_grid_cell;type:smallint"`
+
+	BucketSchemaID uint
+	SignalBuckets  `gorm:"embedded"`
+}
+
+type ExperimentGridCellIndexer struct {
+	ExperimentId uint
+	AntennaId    uint
+	X            int
+	Y            int
+	Z            int
 }